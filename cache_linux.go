@@ -0,0 +1,51 @@
+// cache_linux.go - page cache control for linux
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package fio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysDropCache evicts the range [off, off+n) of fd from the page cache.
+// Dirty pages can't be evicted; so we write them out first.
+func sysDropCache(fd *os.File, off, n int64, dirty bool) {
+	f := int(fd.Fd())
+	if dirty {
+		unix.SyncFileRange(f, off, n, unix.SYNC_FILE_RANGE_WAIT_BEFORE|
+			unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+	}
+	unix.Fadvise(f, off, n, unix.FADV_DONTNEED)
+}
+
+// setDirect enables or disables O_DIRECT I/O on fd
+func setDirect(fd *os.File, on bool) error {
+	f := int(fd.Fd())
+	flags, err := unix.FcntlInt(uintptr(f), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+
+	if on {
+		flags |= unix.O_DIRECT
+	} else {
+		flags &^= unix.O_DIRECT
+	}
+
+	_, err = unix.FcntlInt(uintptr(f), unix.F_SETFL, flags)
+	return err
+}
@@ -0,0 +1,30 @@
+// cache_other.go - page cache control for non-linux platforms
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// we don't have a portable way to evict pages from the cache
+func sysDropCache(fd *os.File, off, n int64, dirty bool) {
+}
+
+// O_DIRECT can't be toggled on an open file
+func setDirect(fd *os.File, on bool) error {
+	return syscall.ENOTSUP
+}
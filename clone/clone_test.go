@@ -15,10 +15,12 @@ package clone
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path"
+	"syscall"
 	"testing"
 	"time"
 
@@ -76,6 +78,24 @@ func TestCloneRegFile(t *testing.T) {
 	assert(err == nil, "clonereg: %s", err)
 }
 
+func TestCloneVerify(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	nm := path.Join(tmp, "testfile")
+	err := mkfilex(nm)
+	assert(err == nil, "test file %s: %s", nm, err)
+
+	var st fio.CopyStats
+	dst := path.Join(tmp, "newfile")
+	err = File(dst, nm, WithCopyOptions(fio.WithVerify(true)), WithCopyStats(&st))
+	assert(err == nil, "clonereg: %s", err)
+	assert(st.Bytes+st.Reflinked > 0, "clonereg: no bytes copied: %s", &st)
+
+	err = mdEqual(dst, nm)
+	assert(err == nil, "clonereg: %s", err)
+}
+
 func TestCloneMtime(t *testing.T) {
 	assert := newAsserter(t)
 	tmp := getTmpdir(t)
@@ -127,6 +147,107 @@ func TestCloneSymlink(t *testing.T) {
 	assert(err == nil, "clonelink: %s", err)
 }
 
+func TestMoveFile(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	// a rename within the same fs
+	nm := path.Join(tmp, "a")
+	err := mkfilex(nm)
+	assert(err == nil, "test file %s: %s", nm, err)
+
+	dst := path.Join(tmp, "b")
+	err = Move(dst, nm)
+	assert(err == nil, "move: %s", err)
+
+	_, err = os.Lstat(nm)
+	assert(os.IsNotExist(err), "move: %s still exists", nm)
+
+	// and across file systems
+	xtmp := xdevTmpdir(t, tmp)
+	ref := path.Join(tmp, "ref")
+	err = File(ref, dst)
+	assert(err == nil, "clone: %s", err)
+
+	xdst := path.Join(xtmp, "c")
+	err = Move(xdst, dst)
+	assert(err == nil, "move: %s", err)
+
+	_, err = os.Lstat(dst)
+	assert(os.IsNotExist(err), "move: %s still exists", dst)
+
+	a, err := fio.Lstat(ref)
+	assert(err == nil, "lstat %s: %s", ref, err)
+	b, err := fio.Lstat(xdst)
+	assert(err == nil, "lstat %s: %s", xdst, err)
+	assert(a.Mode() == b.Mode(), "mode: exp %s, saw %s", a.Mode(), b.Mode())
+	assert(a.Mtim.Equal(b.Mtim), "mtime: exp %s, saw %s", a.Mtim, b.Mtim)
+
+	x, err := os.ReadFile(ref)
+	assert(err == nil, "read %s: %s", ref, err)
+	y, err := os.ReadFile(xdst)
+	assert(err == nil, "read %s: %s", xdst, err)
+	assert(bytes.Equal(x, y), "move: content mismatch")
+}
+
+func TestMoveTree(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+	xtmp := xdevTmpdir(t, tmp)
+
+	src := path.Join(tmp, "lhs")
+	ref := path.Join(tmp, "ref")
+	dst := path.Join(xtmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b", "a/c", "d"}, 3)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	err = Tree(ref, src)
+	assert(err == nil, "clone: %s", err)
+
+	// dst can't be an existing dir
+	err = os.MkdirAll(dst, 0700)
+	assert(err == nil, "mkdir: %s", err)
+	err = Move(dst, src)
+	assert(errors.Is(err, syscall.EEXIST), "move: exp EEXIST, saw %v", err)
+
+	err = os.Remove(dst)
+	assert(err == nil, "rm: %s", err)
+
+	err = Move(dst, src)
+	assert(err == nil, "move: %s", err)
+
+	_, err = os.Lstat(src)
+	assert(os.IsNotExist(err), "move: %s still exists", src)
+
+	err = treeEq(ref, dst, t)
+	assert(err == nil, "cmp: %s", err)
+}
+
+// xdevTmpdir returns a temp dir on a different file system than 'tmp'
+func xdevTmpdir(t *testing.T, tmp string) string {
+	a, err := fio.Lstat(tmp)
+	if err != nil {
+		t.Fatalf("lstat %s: %s", tmp, err)
+	}
+
+	for _, dn := range []string{"/dev/shm", "/var/tmp", os.Getenv("HOME")} {
+		if b, err := fio.Lstat(dn); err == nil && b.IsDir() && a.Dev != b.Dev {
+			xtmp, err := os.MkdirTemp(dn, "fio-test")
+			if err != nil {
+				continue
+			}
+			t.Cleanup(func() {
+				os.RemoveAll(xtmp)
+			})
+			return xtmp
+		}
+	}
+
+	t.Skipf("no other file system for %s", tmp)
+	return ""
+}
+
 func mdEqual(newf, oldf string) error {
 	a, err := fio.Lstat(oldf)
 	if err != nil {
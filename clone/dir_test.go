@@ -14,14 +14,18 @@
 package clone
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/opencoff/go-fio"
 	"github.com/opencoff/go-fio/cmp"
+	"github.com/opencoff/go-fio/walk"
 )
 
 // clone empty dirs
@@ -154,6 +158,196 @@ func TestTreeCloneHardlinks(t *testing.T) {
 	}
 }
 
+// clone dirs with changes on both sides via delta updates
+func TestTreeCloneDelta(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	src := path.Join(tmp, "lhs")
+	dst := path.Join(tmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b", "a/c", "a/d"}, 3)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	err = mkfiles(dst, []string{"a/b", "a/c", "a/d"}, 2)
+	assert(err == nil, "mkfiles dst: %s", err)
+
+	err = Tree(dst, src, WithDelta(4096))
+	assert(err == nil, "clone: %s", err)
+
+	err = treeEq(src, dst, t)
+	assert(err == nil, "cmp: %s", err)
+}
+
+// clone dirs and collect the copy stats
+func TestTreeCloneStats(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	src := path.Join(tmp, "lhs")
+	dst := path.Join(tmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b", "a/c"}, 3)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	var size int64
+	for _, d := range []string{"a/b", "a/c"} {
+		for i := 0; i < 3; i++ {
+			fi, err := fio.Lstat(path.Join(src, d, fmt.Sprintf("f%03d", i)))
+			assert(err == nil, "%s", err)
+			size += fi.Size()
+		}
+	}
+
+	var st fio.CopyStats
+	err = Tree(dst, src, WithCopyStats(&st),
+		WithCopyOptions(fio.WithCopyMethods(fio.COPY_MMAP)))
+	assert(err == nil, "clone: %s", err)
+
+	err = treeEq(src, dst, t)
+	assert(err == nil, "cmp: %s", err)
+
+	assert(st.Method == fio.COPY_MMAP, "exp mmap, saw %s", st.Method)
+	assert(st.Bytes == size, "exp %d bytes, saw %d", size, st.Bytes)
+}
+
+// clone dirs with an adaptive number of workers
+func TestTreeCloneAdaptive(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	src := path.Join(tmp, "lhs")
+	dst := path.Join(tmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b", "a/c", "a/d"}, 5)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	err = mkfiles(dst, []string{"a/b", "a/c"}, 3)
+	assert(err == nil, "mkfiles dst: %s", err)
+
+	wo := walk.Options{
+		Concurrency:    8,
+		MinConcurrency: 1,
+		Type:           walk.ALL,
+	}
+	err = Tree(dst, src, WithWalkOptions(wo))
+	assert(err == nil, "clone: %s", err)
+
+	err = treeEq(src, dst, t)
+	assert(err == nil, "cmp: %s", err)
+}
+
+// clone dirs where the dst has a deep tree that isn't in the src; its
+// nested dirs are removed concurrently.
+func TestTreeCloneNestedDelete(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	src := path.Join(tmp, "lhs")
+	dst := path.Join(tmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b"}, 3)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	deep := []string{"a/b"}
+	nm := "x"
+	for i := range 16 {
+		nm = path.Join(nm, fmt.Sprintf("s%d", i))
+		deep = append(deep, nm)
+	}
+	err = mkfiles(dst, deep, 3)
+	assert(err == nil, "mkfiles dst: %s", err)
+
+	wo := walk.Options{
+		Concurrency: 8,
+		Type:        walk.ALL,
+	}
+	err = Tree(dst, src, WithWalkOptions(wo))
+	assert(err == nil, "clone: %s", err)
+
+	err = treeEq(src, dst, t)
+	assert(err == nil, "cmp: %s", err)
+}
+
+// clone dirs with a cancelled context
+func TestTreeCloneCancel(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	src := path.Join(tmp, "lhs")
+	dst := path.Join(tmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b", "a/c"}, 3)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = TreeContext(ctx, dst, src)
+	assert(errors.Is(err, context.Canceled), "clone: exp cancel, saw %v", err)
+
+	err = TreeContext(context.Background(), dst, src)
+	assert(err == nil, "clone: %s", err)
+
+	err = treeEq(src, dst, t)
+	assert(err == nil, "cmp: %s", err)
+}
+
+// clone dirs while one of the source files is being written to
+func TestTreeCloneInconsistent(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	src := path.Join(tmp, "lhs")
+	dst := path.Join(tmp, "rhs")
+
+	err := mkfiles(src, []string{"a/b", "a/c"}, 3)
+	assert(err == nil, "mkfiles src: %s", err)
+
+	big := path.Join(src, "a", "big")
+	err = os.WriteFile(big, make([]byte, 1024*1024), 0600)
+	assert(err == nil, "write %s: %s", big, err)
+
+	// every chunk copied appends to big; so its copy never sees
+	// a stable source.
+	grow := func(_, _ int64) {
+		fd, err := os.OpenFile(big, os.O_WRONLY|os.O_APPEND, 0600)
+		if err == nil {
+			fd.Write([]byte("x"))
+			fd.Close()
+		}
+	}
+
+	var st fio.CopyStats
+	ob := &inconsistentObserver{Observer: NopObserver()}
+	err = Tree(dst, src, WithObserver(ob), WithCopyStats(&st), WithSourceCheck(1, false),
+		WithCopyOptions(fio.WithCopyMethods(fio.COPY_RW), fio.WithProgress(0, grow)))
+	assert(err == nil, "clone: %s", err)
+
+	want := path.Join(dst, "a", "big")
+	assert(len(ob.seen) == 1 && ob.seen[0] == want, "exp %s to be inconsistent, saw %v", want, ob.seen)
+	assert(st.Inconsistent == 1, "exp 1 inconsistent, saw %s", &st)
+
+	_, err = os.Stat(want)
+	assert(os.IsNotExist(err), "%s: exp to not exist, saw %v", want, err)
+}
+
+// observer that tracks inconsistent copies
+type inconsistentObserver struct {
+	Observer
+
+	sync.Mutex
+	seen []string
+}
+
+var _ InconsistentObserver = &inconsistentObserver{}
+
+func (o *inconsistentObserver) Inconsistent(d, _ string) {
+	o.Lock()
+	o.seen = append(o.seen, d)
+	o.Unlock()
+}
+
 type link struct {
 	src, dst string
 }
@@ -43,24 +43,53 @@ func UpdateMetadata(dst string, fi *fio.Info) error {
 // File clones src to dst - including all clonable file attributes
 // and xattr. File will use the best available CoW facilities provided
 // by the OS and Filesystem. It will fall back to using copy via mmap(2) on
-// systems that don't have CoW semantics.
-func File(dst, src string) error {
+// systems that don't have CoW semantics. Of the options in 'opt', only
+// those relevant to copying a single file are used.
+func File(dst, src string, opt ...Option) error {
+	option := defaultOptions()
+	for _, fp := range opt {
+		fp(&option)
+	}
+
+	st, err := cloneFile(dst, src, &option)
+	if err != nil {
+		return err
+	}
+
+	if option.stats != nil {
+		option.stats.Add(st)
+	}
+	return nil
+}
+
+// clone a single fs entry and return the copy stats
+func cloneFile(dst, src string, opt *treeopt) (*fio.CopyStats, error) {
 	fi, err := fio.Lstat(src)
 	if err != nil {
-		return &Error{"stat-src", src, dst, err}
+		return nil, &Error{"stat-src", src, dst, err}
 	}
 
+	st := &fio.CopyStats{}
 	mode := fi.Mode()
 	if mode.IsRegular() {
 		s, err := os.Open(src)
 		if err != nil {
-			return &Error{"open-src", src, dst, err}
+			return nil, &Error{"open-src", src, dst, err}
 		}
 
 		defer s.Close()
 
-		if err = copyRegular(dst, s, fi); err != nil {
-			return err
+		if st, err = copyRegular(dst, s, fi, opt); err != nil {
+			return nil, err
+		}
+
+		// the copy was restarted because src changed; its metadata
+		// must match the contents we copied. An inconsistent copy
+		// keeps the stale metadata so that the next clone retries it.
+		if st.Retries > 0 && st.Inconsistent == 0 {
+			if nfi, err := fio.Lstat(src); err == nil {
+				fi = nfi
+			}
 		}
 		goto done
 	}
@@ -68,54 +97,70 @@ func File(dst, src string) error {
 	switch mode.Type() {
 	case fs.ModeDir:
 		if err = os.MkdirAll(dst, mode&fs.ModePerm|0100); err != nil {
-			return &Error{"mkdir", src, dst, err}
+			return nil, &Error{"mkdir", src, dst, err}
 		}
 
 	case fs.ModeSymlink:
 		if err = clonelink(dst, src, fi); err != nil {
-			return &Error{"clonelink", src, dst, err}
+			return nil, &Error{"clonelink", src, dst, err}
 		}
 
 	case fs.ModeDevice:
 		if err = mknod(dst, fi); err != nil {
-			return &Error{"mknod", src, dst, err}
+			return nil, &Error{"mknod", src, dst, err}
 		}
 
 	//case ModeSocket: XXX Add named socket support
 
 	default:
 		err = fmt.Errorf("unsupported type %s", mode.Type())
-		return &Error{"file-type", src, dst, err}
+		return nil, &Error{"file-type", src, dst, err}
 	}
 
 done:
-	return updateMeta(dst, fi)
+	if err = updateMeta(dst, fi); err != nil {
+		return nil, err
+	}
+	return st, nil
 }
 
 // copy a regular file to another regular file
-func copyRegular(dst string, s *os.File, fi *fio.Info) error {
+func copyRegular(dst string, s *os.File, fi *fio.Info, opt *treeopt) (*fio.CopyStats, error) {
 	// make the intermediate dirs of the dest
 	dn := filepath.Dir(dst)
 	if err := os.MkdirAll(dn, 0100|fs.ModePerm&fi.Mode()); err != nil {
-		return &Error{"mkdir", s.Name(), dst, err}
+		return nil, &Error{"mkdir", s.Name(), dst, err}
+	}
+
+	// existing files are updated in place; we'll update the perm bits later on
+	if opt.blksz > 0 {
+		if di, err := os.Lstat(dst); err == nil && di.Mode().IsRegular() {
+			copt := append([]fio.CopyOption{fio.WithDelta(opt.blksz)}, opt.copt...)
+			st, err := fio.CopyFileContext(opt.ctx, dst, s.Name(), 0600, copt...)
+			if err != nil {
+				return nil, &Error{"copyfile", s.Name(), dst, err}
+			}
+			return st, nil
+		}
 	}
 
 	// We create the file so that we can write to it; we'll update the perm bits
 	// later on
 	d, err := fio.NewSafeFile(dst, fio.OPT_OVERWRITE, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
 	if err != nil {
-		return &Error{"safefile", s.Name(), dst, err}
+		return nil, &Error{"safefile", s.Name(), dst, err}
 	}
 	defer d.Abort()
 
-	if err = fio.CopyFd(d.File, s); err != nil {
-		return &Error{"copyfile", s.Name(), dst, err}
+	st, err := fio.CopyFdOpts(opt.ctx, d.File, s, opt.copt...)
+	if err != nil {
+		return nil, &Error{"copyfile", s.Name(), dst, err}
 	}
 	if err = d.Close(); err != nil {
-		return &Error{"close", s.Name(), dst, err}
+		return nil, &Error{"close", s.Name(), dst, err}
 	}
 
-	return nil
+	return st, nil
 }
 
 // a cloner clones a specific attribute
@@ -0,0 +1,88 @@
+// move.go - move files and dir trees across file systems
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package clone
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/opencoff/go-fio"
+)
+
+// Move renames src to dst - even if they are on different file systems.
+// Within a file system, Move is just a rename(2). Otherwise src is
+// cloned to dst along with all its metadata, verified and then removed.
+// Regular files are written via a SafeFile and directory trees are
+// cloned to a temporary dir that is renamed to dst; so a failed Move
+// never leaves behind a partial dst. Like os.Rename(), dst can't be an
+// existing dir. The options in 'opt' are used for cloning src.
+func Move(dst, src string, opt ...Option) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return &Error{"rename", src, dst, err}
+	}
+
+	si, err := fio.Lstat(src)
+	if err != nil {
+		return &Error{"lstat-src", src, dst, err}
+	}
+
+	// every file we copy must be identical to the source; we
+	// don't want to remove the only good copy.
+	opt = append(opt, WithCopyOptions(fio.WithVerify(true)))
+	if !si.IsDir() {
+		if err = File(dst, src, opt...); err != nil {
+			return err
+		}
+	} else {
+		if err = moveDir(dst, src, si, opt); err != nil {
+			return err
+		}
+	}
+
+	if err = os.RemoveAll(src); err != nil {
+		return &Error{"rm-src", src, dst, err}
+	}
+	return nil
+}
+
+// clone the dir tree src to a temporary dir and rename it to dst
+func moveDir(dst, src string, si *fio.Info, opt []Option) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp.*")
+	if err != nil {
+		return &Error{"mkdir", src, dst, err}
+	}
+
+	if err = Tree(tmp, src, opt...); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// Tree() doesn't touch the top level dir
+	if err = updateMeta(tmp, si); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return &Error{"rename", src, dst, err}
+	}
+	return nil
+}
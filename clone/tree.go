@@ -14,6 +14,7 @@
 package clone
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -56,6 +57,14 @@ type Observer interface {
 	MetadataUpdate(dst, src string)
 }
 
+// InconsistentObserver is an optional interface for an Observer that
+// wants to know about source files that changed while they were being
+// copied; see WithSourceCheck().
+type InconsistentObserver interface {
+	// src changed while it was being copied to dst
+	Inconsistent(dst, src string)
+}
+
 // WithIgnoreAttr captures the attributes of fio.Info that must be
 // ignored for comparing equality of two filesystem entries.
 func WithIgnoreAttr(fl cmp.IgnoreFlag) Option {
@@ -90,18 +99,90 @@ func WithIgnoreMissing(ign bool) Option {
 	}
 }
 
+// WithCopyOptions uses 'copt' as the options for copying regular files
+func WithCopyOptions(copt ...fio.CopyOption) Option {
+	return func(o *treeopt) {
+		o.copt = append(o.copt, copt...)
+	}
+}
+
+// WithCopyStats accumulates the stats of all the copied files into 'st'
+func WithCopyStats(st *fio.CopyStats) Option {
+	return func(o *treeopt) {
+		o.stats = st
+	}
+}
+
+// WithDelta updates files that exist on both sides by rewriting only
+// the blocks of size 'blksz' that differ; see fio.WithDelta(). Delta
+// updates need reflinks and are linux only; other platforms copy the
+// files in full.
+func WithDelta(blksz int) Option {
+	return func(o *treeopt) {
+		o.blksz = blksz
+	}
+}
+
+// WithSourceCheck detects regular files that are modified while they
+// are being copied; see fio.WithSourceCheck(). Such files are reported
+// to the Observer if it implements InconsistentObserver. If 'commit' is
+// false, they are left untouched in the destination instead of failing
+// the clone.
+func WithSourceCheck(retries int, commit bool) Option {
+	return func(o *treeopt) {
+		o.srccheck = true
+		o.copt = append(o.copt, fio.WithSourceCheck(retries, commit))
+	}
+}
+
+// WithCacheMode copies regular files with the page cache mode 'm';
+// see fio.WithCacheMode().
+func WithCacheMode(m fio.CacheMode) Option {
+	return func(o *treeopt) {
+		o.copt = append(o.copt, fio.WithCacheMode(m))
+	}
+}
+
 type treeopt struct {
 	walk.Options
 
+	// options for copying regular files
+	copt []fio.CopyOption
+
+	// block size for delta updates of existing files
+	blksz int
+
+	// aggregated copy stats
+	stats *fio.CopyStats
+
 	// to report progress
 	o Observer
 
 	// skip files that disappeared
 	ignoreMissing bool
 
+	// report files that changed during the copy
+	srccheck bool
+
 	// file attrs to ignore while computing
 	// file equality.
 	fl cmp.IgnoreFlag
+
+	// instrumentation for the worker pools
+	hook fio.WorkPoolHook
+
+	// cancels the clone
+	ctx context.Context
+}
+
+// WithWorkPoolHook reports the progress of the worker pools used to
+// clone the tree to 'h'. The pools are named "clone-mkdir",
+// "clone-copy" and "clone-link"; the pools that compare the trees are
+// named as in cmp.WithWorkPoolHook().
+func WithWorkPoolHook(h fio.WorkPoolHook) Option {
+	return func(o *treeopt) {
+		o.hook = h
+	}
 }
 
 func defaultOptions() treeopt {
@@ -110,7 +191,8 @@ func defaultOptions() treeopt {
 			Concurrency: runtime.NumCPU(),
 			Type:        walk.ALL,
 		},
-		o: NopObserver(),
+		o:   NopObserver(),
+		ctx: context.Background(),
 	}
 	return opt
 }
@@ -119,6 +201,13 @@ func defaultOptions() treeopt {
 // For example, an entry src/a will be cloned to dst/b. If dst
 // exists, it must be a directory.
 func Tree(dst, src string, opt ...Option) error {
+	return TreeContext(context.Background(), dst, src, opt...)
+}
+
+// TreeContext is like Tree - except the clone stops when 'ctx' is
+// cancelled: the pending copies are abandoned and the context's error
+// is returned. A cancelled clone leaves dst partially updated.
+func TreeContext(ctx context.Context, dst, src string, opt ...Option) error {
 	si, err := fio.Lstat(src)
 	if err != nil {
 		return &Error{"lstat-src", src, dst, err}
@@ -127,6 +216,12 @@ func Tree(dst, src string, opt ...Option) error {
 		return &Error{"clone", src, dst, fmt.Errorf("src is not a dir")}
 	}
 
+	option := defaultOptions()
+	for _, fp := range opt {
+		fp(&option)
+	}
+	option.ctx = ctx
+
 	di, err := fio.Lstat(dst)
 	if err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
@@ -134,7 +229,7 @@ func Tree(dst, src string, opt ...Option) error {
 		}
 
 		// first make the dest dir
-		if err = File(dst, src); err != nil {
+		if _, err = cloneFile(dst, src, &option); err != nil {
 			return err
 		}
 	} else {
@@ -143,13 +238,9 @@ func Tree(dst, src string, opt ...Option) error {
 		}
 	}
 
-	option := defaultOptions()
-	for _, fp := range opt {
-		fp(&option)
-	}
-
-	diff, err := cmp.FsTree(src, dst, cmp.WithIgnoreAttr(option.fl),
+	diff, err := cmp.FsTreeContext(ctx, src, dst, cmp.WithIgnoreAttr(option.fl),
 		cmp.WithObserver(option.o),
+		cmp.WithWorkPoolHook(option.hook),
 		cmp.WithWalkOptions(option.Options))
 	if err != nil {
 		return &Error{"tree-diff", src, dst, err}
@@ -178,17 +269,27 @@ type dircloner struct {
 
 	// sharded dirs that are modified
 	dirs []map[string]bool
+
+	// sharded copy stats
+	cstats []fio.CopyStats
 }
 
 func newCloner(d *cmp.Difference, opt *treeopt) *dircloner {
+	// fio.WorkPool uses all cpus for a concurrency of 1 or less;
+	// we need as many shards as workers.
 	ncpu := opt.Concurrency
+	if ncpu <= 1 {
+		ncpu = runtime.NumCPU()
+	}
 
 	cc := &dircloner{
 		treeopt:    *opt,
 		Difference: d,
 		h:          newHardlinker(),
 		dirs:       make([]map[string]bool, ncpu),
+		cstats:     make([]fio.CopyStats, ncpu),
 	}
+	cc.Concurrency = ncpu
 
 	for i := 0; i < ncpu; i++ {
 		cc.dirs[i] = make(map[string]bool, 8)
@@ -199,23 +300,42 @@ func newCloner(d *cmp.Difference, opt *treeopt) *dircloner {
 	return cc
 }
 
-func (cc *dircloner) xcopy(dst, src string) error {
-	if err := File(dst, src); err != nil {
-		if cc.ignoreMissing && errors.Is(err, fs.ErrNotExist) {
-			return nil
+func (cc *dircloner) xcopy(dst, src string) (*fio.CopyStats, error) {
+	st, err := cloneFile(dst, src, &cc.treeopt)
+	if err != nil {
+		switch {
+		case cc.ignoreMissing && errors.Is(err, fs.ErrNotExist):
+			return &fio.CopyStats{}, nil
+		case cc.srccheck && errors.Is(err, fio.ErrSourceChanged):
+			cc.inconsistent(dst, src)
+			return &fio.CopyStats{Inconsistent: 1}, nil
 		}
-		return err
+		return nil, err
+	}
+
+	if st.Inconsistent > 0 {
+		cc.inconsistent(dst, src)
+	}
+	return st, nil
+}
+
+// report a source that changed while it was being copied
+func (cc *dircloner) inconsistent(dst, src string) {
+	if o, ok := cc.o.(InconsistentObserver); ok {
+		o.Inconsistent(dst, src)
 	}
-	return nil
 }
 
 func (cc *dircloner) clone() error {
 	// first make the new dirs before attempting to make files.
 	// We need to do this first before we copy over any new files.
 	dirs := dirlist(cc.LeftDirs)
-	dirWp := fio.NewWorkPool[copyOp](cc.Concurrency, func(_ int, w copyOp) error {
-		return cc.xcopy(w.dst, w.src)
-	})
+	// we stop at the first error; eg there's no point in continuing
+	// after running out of space.
+	dirWp := fio.NewWorkPoolContext[copyOp](cc.ctx, cc.Concurrency, func(_ context.Context, _ int, w copyOp) error {
+		_, err := cc.xcopy(w.dst, w.src)
+		return err
+	}, cc.poolOpt("clone-mkdir")...)
 
 	dm := cc.dirs[0]
 	for _, nm := range dirs {
@@ -223,7 +343,9 @@ func (cc *dircloner) clone() error {
 		dst := filepath.Join(cc.Dst, nm)
 
 		dm[dst] = true
-		dirWp.Submit(copyOp{src, dst})
+		if dirWp.Submit(copyOp{src, dst}) != nil {
+			break
+		}
 		cc.o.Mkdir(dst)
 	}
 	dirWp.Close()
@@ -235,11 +357,11 @@ func (cc *dircloner) clone() error {
 	// each worker will track the dirs they modify in a sharded map
 	// the shards will be combined later
 
-	wp := fio.NewWorkPool[work](cc.Concurrency, func(i int, w work) error {
+	wp := fio.NewWorkPoolContext[work](cc.ctx, cc.Concurrency, func(_ context.Context, i int, w work) error {
 		var err error
-		cc.dirs[i], err = cc.dowork(cc.dirs[i], w)
+		cc.dirs[i], err = cc.dowork(cc.dirs[i], &cc.cstats[i], w)
 		return err
-	})
+	}, cc.poolOpt("clone-copy")...)
 
 	// now submit work to the workpool
 
@@ -253,7 +375,9 @@ func (cc *dircloner) clone() error {
 	wg.Add(1)
 	go func() {
 		cc.RightFiles.Range(func(_ string, fi *fio.Info) bool {
-			wp.Submit(&delOp{fi.Path()})
+			if wp.Submit(&delOp{fi.Path()}) != nil {
+				return false
+			}
 			cc.o.Delete(fi.Path())
 			return true
 		})
@@ -263,7 +387,9 @@ func (cc *dircloner) clone() error {
 	wg.Add(1)
 	go func() {
 		cc.RightDirs.Range(func(_ string, fi *fio.Info) bool {
-			wp.Submit(&delOp{fi.Path()})
+			if wp.Submit(&delOp{fi.Path()}) != nil {
+				return false
+			}
 			cc.o.Delete(fi.Path())
 			return true
 		})
@@ -278,7 +404,9 @@ func (cc *dircloner) clone() error {
 			dst := p.Dst.Path()
 
 			if linked := cc.h.track(p.Src, dst); !linked {
-				wp.Submit(&copyOp{src, dst})
+				if wp.Submit(&copyOp{src, dst}) != nil {
+					return false
+				}
 				cc.o.Copy(dst, src)
 			}
 			return true
@@ -293,7 +421,9 @@ func (cc *dircloner) clone() error {
 			dst := filepath.Join(cc.Dst, nm)
 
 			if linked := cc.h.track(fi, dst); !linked {
-				wp.Submit(&copyOp{src, dst})
+				if wp.Submit(&copyOp{src, dst}) != nil {
+					return false
+				}
 				cc.o.Copy(dst, src)
 			}
 			return true
@@ -309,17 +439,19 @@ func (cc *dircloner) clone() error {
 	}
 
 	// now complete the pending hardlinks
-	wp = fio.NewWorkPool[work](cc.Concurrency, func(i int, w work) error {
+	wp = fio.NewWorkPoolContext[work](cc.ctx, cc.Concurrency, func(_ context.Context, i int, w work) error {
 		var err error
-		cc.dirs[i], err = cc.dowork(cc.dirs[i], w)
+		cc.dirs[i], err = cc.dowork(cc.dirs[i], &cc.cstats[i], w)
 		return err
-	})
+	}, cc.poolOpt("clone-link")...)
 
 	wg.Add(1)
 	go func() {
+		// links to the same inode are made in order
 		cc.h.hardlinks(func(d, s string) {
-			wp.Submit(&linkOp{s, d})
-			cc.o.Link(d, s)
+			if wp.SubmitKeyed(s, &linkOp{s, d}) == nil {
+				cc.o.Link(d, s)
+			}
 		})
 		wg.Done()
 	}()
@@ -338,10 +470,29 @@ func (cc *dircloner) clone() error {
 		}
 	}
 
+	if cc.stats != nil {
+		for i := range cc.cstats {
+			cc.stats.Add(&cc.cstats[i])
+		}
+	}
+
 	// fixup mtimes of modified dirs
 	return cc.fixup(dirmap)
 }
 
+// return the options for the worker pool 'nm'; we stop at the first
+// error.
+func (cc *dircloner) poolOpt(nm string) []fio.WorkPoolOption {
+	opt := []fio.WorkPoolOption{fio.WithFailFast(true)}
+	if cc.MinConcurrency > 0 {
+		opt = append(opt, fio.WithAdaptive(cc.MinConcurrency))
+	}
+	if cc.hook != nil {
+		opt = append(opt, fio.WithWorkPoolHook(nm, cc.hook))
+	}
+	return opt
+}
+
 // fixup dst dirs - esp their mtimes; the files would've been written in
 // random order
 func (cc *dircloner) fixup(dmap map[string]bool) error {
@@ -393,7 +544,7 @@ func _Keys[M ~map[K]V, K comparable, V any](m M) []K {
 	return v
 }
 
-func (cc *dircloner) dowork(dirs map[string]bool, w work) (map[string]bool, error) {
+func (cc *dircloner) dowork(dirs map[string]bool, stats *fio.CopyStats, w work) (map[string]bool, error) {
 	track := func(p string) {
 		dn := filepath.Dir(p)
 		dirs[dn] = true
@@ -401,14 +552,18 @@ func (cc *dircloner) dowork(dirs map[string]bool, w work) (map[string]bool, erro
 
 	switch z := w.(type) {
 	case *copyOp:
-		if err := cc.xcopy(z.dst, z.src); err != nil {
+		st, err := cc.xcopy(z.dst, z.src)
+		if err != nil {
 			return dirs, err
 		}
+		stats.Add(st)
 		track(z.dst)
 
 	case *delOp:
-		err := os.RemoveAll(z.name)
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// we're already running concurrently; and the nested dirs
+		// in RightDirs race with the removal of their parents.
+		err := fio.RemoveTree(z.name, fio.WithOneFS(cc.OneFS), fio.WithRemoveWorkers(1))
+		if err != nil {
 			return dirs, &Error{"rm", cc.Src, cc.Dst, err}
 		}
 		track(filepath.Dir(z.name))
@@ -14,9 +14,9 @@
 package cmp
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
-	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -62,6 +62,9 @@ type cmpopt struct {
 	deepEq func(lhs, rhs *fio.Info) bool
 
 	o Observer
+
+	// instrumentation for the worker pools
+	hook fio.WorkPoolHook
 }
 
 func defaultOptions() cmpopt {
@@ -127,6 +130,28 @@ func WithConcurrency(n int) Option {
 	}
 }
 
+// WithAdaptiveConcurrency adapts the number of concurrent goroutines
+// to the observed throughput - between nmin and nmax. See
+// walk.Options.MinConcurrency.
+func WithAdaptiveConcurrency(nmin, nmax int) Option {
+	return func(o *cmpopt) {
+		if nmax <= 0 {
+			nmax = runtime.NumCPU()
+		}
+		o.MinConcurrency = min(max(nmin, 1), nmax)
+		o.Concurrency = nmax
+	}
+}
+
+// WithWorkPoolHook reports the progress of the worker pools that
+// compare the trees to 'h'; the pools are named "cmp-lhs" and
+// "cmp-rhs".
+func WithWorkPoolHook(h fio.WorkPoolHook) Option {
+	return func(o *cmpopt) {
+		o.hook = h
+	}
+}
+
 // Observer is invoked when the comparator visits entries
 // in src and dst.
 type Observer interface {
@@ -247,8 +272,18 @@ func (d *Difference) String() string {
 // it compares file size and mtime to determine change.
 // For all entries, it compares every comparable attribute of fio.Info - unless
 // explicitly ignored (by using the option WithIgnore()). The ignorable
-// attributes are identified by IGN_xxx constants.
+// attributes are identified by IGN_xxx constants. Entries are compared by
+// their path relative to 'src' and 'dst'; when the walk follows symlinks
+// (walk.Options.FollowSymlinks), the entries reached through a symlink
+// are named by the location of the link within the tree - not by the
+// path of its target.
 func FsTree(src, dst string, opt ...Option) (*Difference, error) {
+	return FsTreeContext(context.Background(), src, dst, opt...)
+}
+
+// FsTreeContext is like FsTree - except the traversal of the trees stops
+// when 'ctx' is cancelled and the context's error is returned.
+func FsTreeContext(ctx context.Context, src, dst string, opt ...Option) (*Difference, error) {
 	lfi, err := fio.Lstat(src)
 	if err != nil {
 		return nil, &Error{"lstat-src", src, dst, err}
@@ -278,7 +313,10 @@ func FsTree(src, dst string, opt ...Option) (*Difference, error) {
 
 	// since we're doing both walks in parallel, we ensure concurrency limits
 	// are honored
-	wo.Concurrency = wo.Concurrency / 2
+	wo.Concurrency = max(wo.Concurrency/2, 1)
+	if wo.MinConcurrency > 0 {
+		wo.MinConcurrency = max(wo.MinConcurrency/2, 1)
+	}
 
 	var wg sync.WaitGroup
 	var err_L, err_R error
@@ -289,9 +327,8 @@ func FsTree(src, dst string, opt ...Option) (*Difference, error) {
 	rhs := fio.NewMap()
 
 	go func(w *sync.WaitGroup) {
-		err := walk.WalkFunc([]string{src}, wo, func(fi *fio.Info) error {
-			rel, _ := filepath.Rel(src, fi.Path())
-			if rel != "." {
+		err := walk.WalkFuncContext(ctx, []string{src}, wo, func(fi *fio.Info) error {
+			if rel := fi.RelPath(); rel != "." {
 				lhs.Store(rel, fi)
 				option.o.VisitSrc(fi)
 			}
@@ -304,9 +341,8 @@ func FsTree(src, dst string, opt ...Option) (*Difference, error) {
 	}(&wg)
 
 	go func(w *sync.WaitGroup) {
-		err := walk.WalkFunc([]string{dst}, wo, func(fi *fio.Info) error {
-			rel, _ := filepath.Rel(dst, fi.Path())
-			if rel != "." {
+		err := walk.WalkFuncContext(ctx, []string{dst}, wo, func(fi *fio.Info) error {
+			if rel := fi.RelPath(); rel != "." {
 				rhs.Store(rel, fi)
 				option.o.VisitDst(fi)
 			}
@@ -0,0 +1,59 @@
+// cmp_test.go -- tests for comparing file system trees
+//
+// (c) 2024- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package cmp_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencoff/go-fio/cmp"
+	"github.com/opencoff/go-fio/walk"
+)
+
+// entries reached via a followed symlink are compared by the name of
+// the link within the tree - not by the path of its target.
+func TestFsTreeFollowSymlinks(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	lhs := filepath.Join(tmpdir, "lhs")
+	rhs := filepath.Join(tmpdir, "rhs")
+	ext := filepath.Join(tmpdir, "ext")
+
+	for _, nm := range []string{"ext/f", "lhs/a", "rhs/a", "rhs/link/f"} {
+		err := mkfilex(filepath.Join(tmpdir, nm))
+		assert(err == nil, "mkfile: %s", err)
+	}
+
+	err := os.Symlink(ext, filepath.Join(lhs, "link"))
+	assert(err == nil, "symlink: %s", err)
+
+	wo := walk.Options{
+		Type:           walk.ALL,
+		FollowSymlinks: true,
+	}
+	d, err := cmp.FsTree(lhs, rhs, cmp.WithWalkOptions(wo))
+	assert(err == nil, "fstree: %s", err)
+
+	for _, nm := range []string{"a", "link", "link/f"} {
+		_, ok := d.Lhs.Load(nm)
+		assert(ok, "lhs: missing %s", nm)
+		_, ok = d.Rhs.Load(nm)
+		assert(ok, "rhs: missing %s", nm)
+	}
+	assert(d.Lhs.Size() == 3, "lhs: exp 3 entries, saw %d", d.Lhs.Size())
+	assert(d.LeftFiles.Size() == 0, "exp no lhs-only files, saw %d", d.LeftFiles.Size())
+	assert(d.RightFiles.Size() == 0, "exp no rhs-only files, saw %d", d.RightFiles.Size())
+}
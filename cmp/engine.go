@@ -28,12 +28,11 @@ func (c *cmp) doDiff() error {
 	wp := fio.NewWorkPool[work](c.Concurrency, func(i int, w work) error {
 		c.lhsDiff(w.nm, w.fi)
 		return nil
-	})
+	}, c.poolOpt("cmp-lhs")...)
 
 	c.lhs.Range(func(nm string, fi *fio.Info) bool {
 		w := work{nm, fi}
-		wp.Submit(w)
-		return true
+		return wp.Submit(w) == nil
 	})
 	wp.Close()
 
@@ -47,17 +46,28 @@ func (c *cmp) doDiff() error {
 	wp = fio.NewWorkPool[work](c.Concurrency, func(i int, w work) error {
 		c.rhsDiff(w.nm, w.fi)
 		return nil
-	})
+	}, c.poolOpt("cmp-rhs")...)
 	c.rhs.Range(func(nm string, fi *fio.Info) bool {
 		w := work{nm, fi}
-		wp.Submit(w)
-		return true
+		return wp.Submit(w) == nil
 	})
 	wp.Close()
 
 	return wp.Wait()
 }
 
+// return the options for the worker pool 'nm'
+func (c *cmp) poolOpt(nm string) []fio.WorkPoolOption {
+	var opt []fio.WorkPoolOption
+	if c.MinConcurrency > 0 {
+		opt = append(opt, fio.WithAdaptive(c.MinConcurrency))
+	}
+	if c.hook != nil {
+		opt = append(opt, fio.WithWorkPoolHook(nm, c.hook))
+	}
+	return opt
+}
+
 func (c *cmp) lhsDiff(nm string, lhs *fio.Info) {
 	c.o.VisitSrc(lhs)
 
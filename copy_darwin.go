@@ -23,23 +23,62 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func sysCopyFile(dst, src string, perm fs.FileMode) error {
-	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
-	if err == nil {
-		return nil
+func sysCopyFile(c *copier, dst, src string, perm fs.FileMode) error {
+	st, err := os.Lstat(src)
+	if err != nil {
+		return &CopyError{"stat-src", src, dst, err}
 	}
 
-	if !errAny(err, syscall.ENOTSUP, syscall.ENOSYS) {
-		return &CopyError{"clone", src, dst, err}
+	c.begin(st.Size())
+	if c.allow(COPY_REFLINK) {
+		err = unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+		if err == nil {
+			c.used(COPY_REFLINK, st.Size())
+			// a reflink moves no data; so it isn't rate limited
+			if err = c.skip(st.Size()); err != nil {
+				os.Remove(dst)
+				return &CopyError{"cancel", src, dst, err}
+			}
+			if err = checkClone(c, dst, src); err != nil {
+				os.Remove(dst)
+				return err
+			}
+			return nil
+		}
+
+		if !errAny(err, syscall.ENOTSUP, syscall.ENOSYS) {
+			return &CopyError{"clone", src, dst, err}
+		}
 	}
 
 	// fallback
-	return slowCopy(dst, src, perm)
+	return slowCopy(c, dst, src, perm)
+}
+
+// verify a file cloned via clonefile(2)
+func checkClone(c *copier, dst, src string) error {
+	if !c.verify {
+		return nil
+	}
+
+	s, err := os.Open(src)
+	if err != nil {
+		return &CopyError{"open-src", src, dst, err}
+	}
+	defer s.Close()
+
+	d, err := os.Open(dst)
+	if err != nil {
+		return &CopyError{"open-dst", src, dst, err}
+	}
+	defer d.Close()
+
+	return c.check(d, s)
 }
 
 // macOS doesn't have the equiv fclonefile() that takes two fds.
 // And clonefile(2) and fclonefileat(2) both require that the
 // destination file NOT exist. So, we are stuck with slow path
-func sysCopyFd(d, s *os.File) error {
-	return copyViaMmap(d, s)
+func sysCopyFd(c *copier, d, s *os.File) error {
+	return copyFallback(c, d, s)
 }
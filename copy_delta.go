@@ -0,0 +1,154 @@
+// copy_delta.go - update a file by rewriting only its changed blocks
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// deltaCopy updates dst to be identical to src by rewriting only
+// the blocks that differ. The new contents are assembled in a SafeFile
+// that is seeded with a reflink of the existing dst; without a reflink
+// there is nothing to be gained and we fallback to a full copy. This is
+// always the case on platforms that can't reflink open files (eg
+// darwin, where clonefile(2) needs a dst that doesn't exist).
+func deltaCopy(c *copier, dst, src string, perm fs.FileMode) error {
+	if !c.allow(COPY_DELTA) || !c.allow(COPY_REFLINK) {
+		return sysCopyFile(c, dst, src, perm)
+	}
+
+	o, err := os.Open(dst)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return sysCopyFile(c, dst, src, perm)
+		}
+		return &CopyError{"open-dst", src, dst, err}
+	}
+
+	defer o.Close()
+
+	oi, err := o.Stat()
+	if err != nil {
+		return &CopyError{"stat-dst", src, dst, err}
+	}
+
+	if !oi.Mode().IsRegular() {
+		return sysCopyFile(c, dst, src, perm)
+	}
+
+	s, err := os.Open(src)
+	if err != nil {
+		return &CopyError{"open-src", src, dst, err}
+	}
+
+	defer s.Close()
+
+	si, err := s.Stat()
+	if err != nil {
+		return &CopyError{"stat-src", src, dst, err}
+	}
+
+	d, err := NewSafeFile(dst, OPT_OVERWRITE, os.O_CREATE|os.O_RDWR|os.O_EXCL, perm)
+	if err != nil {
+		return &CopyError{"safefile", src, dst, err}
+	}
+
+	defer d.Abort()
+
+	if err = deltaSeed(d.File, o); err != nil {
+		if !errAny(err, errNoReflink...) {
+			return &CopyError{"clone", src, dst, err}
+		}
+
+		// we're better off doing a full copy
+		if err = copyFd(c, d.File, s); err != nil {
+			return err
+		}
+	} else {
+		c.used(COPY_REFLINK, oi.Size())
+		if err = copyDelta(c, d.File, s, si.Size()); err != nil {
+			return err
+		}
+
+		if err = c.check(d.File, s); err != nil {
+			return err
+		}
+	}
+
+	if err = d.Close(); err != nil {
+		return &CopyError{"close", src, dst, err}
+	}
+	return nil
+}
+
+// deltaSeed seeds the new file 'dst' of a delta copy with the contents
+// of the existing destination 'src'; tests replace it on file systems
+// that can't reflink.
+var deltaSeed = sysReflink
+
+// copyDelta compares successive blocks of src and dst and writes the
+// blocks of src that differ to dst. Finally dst is truncated to 'sz'.
+func copyDelta(c *copier, dst, src *os.File, sz int64) error {
+	c.begin(sz)
+
+	// a delta copy may not find any blocks to write
+	c.used(COPY_DELTA, 0)
+
+	sbuf := make([]byte, c.blksz)
+	dbuf := make([]byte, c.blksz)
+
+	for off := int64(0); off < sz; {
+		n := int(min(int64(c.blksz), sz-off))
+		sb := sbuf[:n]
+
+		m, err := src.ReadAt(sb, off)
+		if err != nil && !(err == io.EOF && m == n) {
+			return &CopyError{"read", src.Name(), dst.Name(), err}
+		}
+
+		// a short read of dst just means dst is smaller
+		m, err = dst.ReadAt(dbuf[:n], off)
+		if err != nil && err != io.EOF {
+			return &CopyError{"read", src.Name(), dst.Name(), err}
+		}
+
+		if !bytes.Equal(sb, dbuf[:m]) {
+			if _, err = dst.WriteAt(sb, off); err != nil {
+				return &CopyError{"write", src.Name(), dst.Name(), err}
+			}
+			c.used(COPY_DELTA, int64(n))
+		}
+
+		c.hash(sb)
+		c.drop(dst, src, off, int64(n))
+		if err = c.update(int64(n)); err != nil {
+			return &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
+		off += int64(n)
+	}
+	c.hashed = true
+
+	if err := dst.Truncate(sz); err != nil {
+		return &CopyError{"truncate", src.Name(), dst.Name(), err}
+	}
+
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return &CopyError{"seek", src.Name(), dst.Name(), err}
+	}
+	return nil
+}
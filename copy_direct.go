@@ -0,0 +1,166 @@
+// copy_direct.go - copy via O_DIRECT I/O that bypasses the page cache
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// O_DIRECT I/O needs buffers, offsets and sizes that are aligned to the
+// logical block size of the device. This is a safe upper bound.
+const _directAlign int = 4096
+
+// tryDirect copies 'sz' bytes of src to dst via O_DIRECT if the cache
+// mode asks for it. It returns false if the caller must copy the file
+// some other way.
+func tryDirect(c *copier, dst, src *os.File, sz int64) (bool, error) {
+	if c.cache != CACHE_DIRECT || !c.allow(COPY_RW) {
+		return false, nil
+	}
+
+	err := copyDirect(c, dst, src, sz)
+	if err == nil {
+		return true, nil
+	}
+
+	// we can only fallback if nothing was copied
+	if c.stats.Bytes > 0 || !errAny(err, syscall.EINVAL, syscall.ENOTSUP) {
+		return true, err
+	}
+
+	// forget the holes we skipped
+	c.rewind()
+	return false, nil
+}
+
+// copyDirect copies the data regions in the first 'sz' bytes of src to
+// dst with O_DIRECT enabled on both; the holes of a sparse source are
+// skipped. The unaligned edges of each region are copied with buffered
+// I/O and then evicted from the page cache.
+func copyDirect(c *copier, dst, src *os.File, sz int64) error {
+	if err := setDirect(src, true); err != nil {
+		return &CopyError{"o_direct", src.Name(), dst.Name(), err}
+	}
+	defer setDirect(src, false)
+
+	if err := setDirect(dst, true); err != nil {
+		return &CopyError{"o_direct", src.Name(), dst.Name(), err}
+	}
+	defer setDirect(dst, false)
+
+	// we skip holes and copy the edges last; so we can't compute a
+	// running checksum. c.check() will re-read the source.
+	c.sum = nil
+	c.hashed = false
+
+	buf := alignedBuf(_ioChunkSize)
+	mask := int64(_directAlign - 1)
+
+	// the unaligned edges are copied after we disable O_DIRECT
+	var edges []fileRange
+	var prev int64
+	err := dataExtents(src, sz, func(start, end int64) error {
+		if start > prev {
+			if err := c.hole(start - prev); err != nil {
+				return &CopyError{"cancel", src.Name(), dst.Name(), err}
+			}
+		}
+		prev = end
+
+		astart := (start + mask) &^ mask
+		aend := end &^ mask
+		if astart >= aend {
+			edges = append(edges, fileRange{start, end - start})
+			return nil
+		}
+
+		if astart > start {
+			edges = append(edges, fileRange{start, astart - start})
+		}
+		if end > aend {
+			edges = append(edges, fileRange{aend, end - aend})
+		}
+		return copyDirectRange(c, dst, src, buf, astart, aend)
+	})
+
+	var cerr *CopyError
+	switch {
+	case errors.As(err, &cerr):
+		return err
+	case err != nil:
+		return &CopyError{"seek-data", src.Name(), dst.Name(), err}
+	}
+
+	if sz > prev {
+		if err = c.hole(sz - prev); err != nil {
+			return &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
+	}
+
+	if len(edges) > 0 {
+		setDirect(src, false)
+		setDirect(dst, false)
+		for _, r := range edges {
+			if err = copyRW(c, dst, src, r.off, r.n); err != nil {
+				return err
+			}
+		}
+	}
+
+	// account for a trailing hole
+	if err = dst.Truncate(sz); err != nil {
+		return &CopyError{"truncate", src.Name(), dst.Name(), err}
+	}
+
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return &CopyError{"seek", src.Name(), dst.Name(), err}
+	}
+	return nil
+}
+
+// copy the aligned range [off, end) of src to dst via O_DIRECT
+func copyDirectRange(c *copier, dst, src *os.File, buf []byte, off, end int64) error {
+	for off < end {
+		b := buf[:min(int64(len(buf)), end-off)]
+		if _, err := src.ReadAt(b, off); err != nil {
+			return &CopyError{"read", src.Name(), dst.Name(), err}
+		}
+
+		if _, err := dst.WriteAt(b, off); err != nil {
+			return &CopyError{"write", src.Name(), dst.Name(), err}
+		}
+
+		n := int64(len(b))
+		c.used(COPY_RW, n)
+		if err := c.update(n); err != nil {
+			return &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
+		off += n
+	}
+	return nil
+}
+
+// alignedBuf returns a buffer of 'n' bytes whose address is aligned
+// for O_DIRECT I/O. The go runtime doesn't move heap objects; so the
+// alignment holds for the life of the buffer.
+func alignedBuf(n int) []byte {
+	b := make([]byte, n+_directAlign)
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	i := int((uintptr(_directAlign) - p%uintptr(_directAlign)) % uintptr(_directAlign))
+	return b[i : i+n]
+}
@@ -0,0 +1,84 @@
+// copy_fallback.go - file copy for platforms without copy_file_range(2)
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// copy_file_range(2) is linux specific
+const _haveCopyRange = false
+
+func copyRangeAt(c *copier, dst, src *os.File, off, n int64) error {
+	return &CopyError{"copy_file_range", src.Name(), dst.Name(), syscall.ENOTSUP}
+}
+
+// we can't reflink a file via an open fd
+func sysReflink(dst, src *os.File) error {
+	return syscall.ENOTSUP
+}
+
+// splice(2) is linux specific
+func sysSplice(c *copier, dst, src *os.File) error {
+	return &CopyError{"splice", src.Name(), dst.Name(), syscall.ENOTSUP}
+}
+
+// we can't find the data regions of a sparse file
+func sysPrealloc(dst, src *os.File, sz int64) error {
+	return syscall.ENOTSUP
+}
+
+// we can't find the data regions of a sparse file; so all of it is data
+func dataExtents(src *os.File, sz int64, fp func(start, end int64) error) error {
+	if sz > 0 {
+		return fp(0, sz)
+	}
+	return nil
+}
+
+// copy src to dst; we copy large files in parallel
+func copyFallback(c *copier, dst, src *os.File) error {
+	st, err := src.Stat()
+	if err != nil {
+		return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+	}
+
+	sz := st.Size()
+	c.begin(sz)
+
+	if err = c.preallocate(dst, src, sz); err != nil {
+		return err
+	}
+
+	if ok, err := tryDirect(c, dst, src, sz); ok {
+		return err
+	}
+
+	if ok, err := tryParallel(c, dst, src, sz); ok {
+		return err
+	}
+
+	if c.mmap() {
+		return copyViaMmap(c, dst, src)
+	}
+
+	if c.allow(COPY_RW) {
+		return copyViaRW(c, dst, src)
+	}
+
+	return &CopyError{"copy", src.Name(), dst.Name(), ErrNoCopyMethod}
+}
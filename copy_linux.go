@@ -16,19 +16,17 @@
 package fio
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
-	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-// Do copies in chunks of _ioChunkSize
-const _ioChunkSize int = 256 * 1024
-
 // optimized copy for linux and safe fallback to mmap
-func sysCopyFile(dst, src string, perm fs.FileMode) error {
+func sysCopyFile(c *copier, dst, src string, perm fs.FileMode) error {
 	s, err := os.Open(src)
 	if err != nil {
 		return &CopyError{"open-src", src, dst, err}
@@ -55,14 +53,12 @@ func sysCopyFile(dst, src string, perm fs.FileMode) error {
 		return &CopyError{"fstat-dst", src, dst, err}
 	}
 
-	switch di.IsSameFS(si) {
-	case true:
-		err = sysCopyFd(d.File, s)
-	case false:
-		err = copyViaMmap(d.File, s)
+	// reflinks and copy_file_range(2) only work within a file system
+	if !di.IsSameFS(si) {
+		c.methods &= COPY_MMAP | COPY_RW
 	}
 
-	if err != nil {
+	if err = copyFd(c, d.File, s); err != nil {
 		return err
 	}
 
@@ -74,32 +70,134 @@ func sysCopyFile(dst, src string, perm fs.FileMode) error {
 	return nil
 }
 
+// We can copy ranges of files via copy_file_range(2)
+const _haveCopyRange = true
+
 // try to use reflinks for copying where possible.
-// Fallback to copy_file_range(2) which is available on all linuxes.
-func sysCopyFd(dst, src *os.File) error {
-	d := int(dst.Fd())
-	s := int(src.Fd())
+// Fallback to copy_file_range(2) which is available on all linuxes;
+// and finally fallback to mmap or read/write if all else fails.
+func sysCopyFd(c *copier, dst, src *os.File) error {
+	st, err := Fstat(src)
+	if err != nil {
+		return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+	}
+
+	sz := st.Size()
+	c.begin(sz)
 
 	// First try to reflink.
-	err := unix.IoctlFileClone(int(d), int(s))
-	if err == nil {
-		return nil
+	if c.allow(COPY_REFLINK) {
+		err = sysReflink(dst, src)
+		if err == nil {
+			c.used(COPY_REFLINK, sz)
+			// a reflink moves no data; so it isn't rate limited
+			if err = c.skip(sz); err != nil {
+				return &CopyError{"cancel", src.Name(), dst.Name(), err}
+			}
+			return nil
+		}
+		if !errAny(err, errNoReflink...) {
+			return &CopyError{"clone", src.Name(), dst.Name(), err}
+		}
 	}
-	if !errAny(err, syscall.ENOTSUP, syscall.ENOSYS, syscall.EXDEV) {
-		return &CopyError{"clone", src.Name(), dst.Name(), err}
+
+	if err = c.preallocate(dst, src, sz); err != nil {
+		return err
 	}
 
-	st, err := Fstat(src)
+	if ok, err := tryDirect(c, dst, src, sz); ok {
+		return err
+	}
+
+	if ok, err := tryParallel(c, dst, src, sz); ok {
+		return err
+	}
+
+	if c.allow(COPY_RANGE) {
+		err = copyRange(c, dst, src, sz)
+		if err == nil {
+			return nil
+		}
+
+		// we can only fallback if nothing was copied
+		if c.stats.Bytes > 0 || !errAny(err, errNoCopyRange...) {
+			return err
+		}
+	}
+
+	if c.mmap() {
+		return copyViaMmap(c, dst, src)
+	}
+
+	if c.allow(COPY_RW) {
+		return copyViaRW(c, dst, src)
+	}
+
+	return &CopyError{"copy", src.Name(), dst.Name(), ErrNoCopyMethod}
+}
+
+// reflink src to dst
+func sysReflink(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// copy 'sz' bytes from src to dst via copy_file_range(2). We skip
+// the holes in sparse files and extend dst to the full size at the end.
+func copyRange(c *copier, dst, src *os.File, sz int64) error {
+	s := int(src.Fd())
+
+	// SEEK_DATA/SEEK_HOLE moves the file offset of src; we restore it
+	// when we're done.
+	cur, err := unix.Seek(s, 0, io.SeekCurrent)
 	if err != nil {
-		return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+		return &CopyError{"seek", src.Name(), dst.Name(), err}
 	}
 
-	// Fallback to copy_file_range(2)
-	var roff, woff int64
-	sz := st.Size()
-	for sz > 0 {
-		n := min(_ioChunkSize, int(sz))
-		m, err := unix.CopyFileRange(s, &roff, d, &woff, n, 0)
+	defer unix.Seek(s, cur, io.SeekStart)
+
+	var off int64
+	for off < sz {
+		start, end, err := nextExtent(s, off, sz)
+		if err != nil {
+			return &CopyError{"seek-data", src.Name(), dst.Name(), err}
+		}
+
+		if hole := start - off; hole > 0 {
+			if err = c.hole(hole); err != nil {
+				return &CopyError{"cancel", src.Name(), dst.Name(), err}
+			}
+		}
+
+		if err = copyRangeAt(c, dst, src, start, end-start); err != nil {
+			return err
+		}
+		off = end
+	}
+
+	// account for a trailing hole
+	if err = dst.Truncate(sz); err != nil {
+		return &CopyError{"truncate", src.Name(), dst.Name(), err}
+	}
+
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return &CopyError{"seek", src.Name(), dst.Name(), err}
+	}
+
+	return nil
+}
+
+// copy 'n' bytes at offset 'off' from src to dst via copy_file_range(2).
+// The file offsets of src and dst are unchanged; so this is safe to call
+// concurrently for non-overlapping ranges.
+func copyRangeAt(c *copier, dst, src *os.File, off, n int64) error {
+	d := int(dst.Fd())
+	s := int(src.Fd())
+
+	// the kernel advances roff and woff by the number of bytes copied.
+	roff, woff := off, off
+	for end := off + n; roff < end; {
+		z := int(min(int64(_ioChunkSize), end-roff))
+		m, err := unix.CopyFileRange(s, &roff, d, &woff, z, 0)
 		if err != nil {
 			return &CopyError{"copy_file_range", src.Name(), dst.Name(), err}
 		}
@@ -107,14 +205,116 @@ func sysCopyFd(dst, src *os.File) error {
 			return &CopyError{"copy_file_range", src.Name(), dst.Name(),
 				fmt.Errorf("zero sized transfer at off %d", roff)}
 		}
-		sz -= int64(m)
-		roff += int64(m)
-		woff += int64(m)
+
+		c.drop(dst, src, roff-int64(m), int64(m))
+		c.used(COPY_RANGE, int64(m))
+		if err = c.update(int64(m)); err != nil {
+			return &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
 	}
+	return nil
+}
 
-	if _, err = dst.Seek(0, os.SEEK_SET); err != nil {
-		return &CopyError{"seek", src.Name(), dst.Name(), err}
+// copy the pipe src to dst via splice(2) until we see EOF. The pipe may
+// be in non-blocking mode; so we let the runtime poller wait for data.
+func sysSplice(c *copier, dst, src *os.File) error {
+	rc, err := src.SyscallConn()
+	if err != nil {
+		return &CopyError{"splice", src.Name(), dst.Name(), err}
+	}
+
+	d := int(dst.Fd())
+	for {
+		var n int64
+		var serr error
+
+		err = rc.Read(func(fd uintptr) bool {
+			n, serr = unix.Splice(int(fd), nil, d, nil, _ioChunkSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+			return serr != unix.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return &CopyError{"splice", src.Name(), dst.Name(), err}
+		case n == 0:
+			if _, err = dst.Seek(0, io.SeekStart); err != nil {
+				return &CopyError{"seek", src.Name(), dst.Name(), err}
+			}
+			return nil
+		}
+
+		c.used(COPY_SPLICE, n)
+		if err = c.update(n); err != nil {
+			return &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
 	}
+}
+
+// allocate the blocks of dst that correspond to the data regions of
+// the first 'sz' bytes of src. We don't change the size of dst; so the
+// copy methods can extend it as usual.
+func sysPrealloc(dst, src *os.File, sz int64) error {
+	d := int(dst.Fd())
+	return dataExtents(src, sz, func(start, end int64) error {
+		return unix.Fallocate(d, unix.FALLOC_FL_KEEP_SIZE, start, end-start)
+	})
+}
 
+// dataExtents calls 'fp' for each region of data [start, end) in the
+// first 'sz' bytes of src. The file offset of src is unchanged.
+func dataExtents(src *os.File, sz int64, fp func(start, end int64) error) error {
+	s := int(src.Fd())
+
+	cur, err := unix.Seek(s, 0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Seek(s, cur, io.SeekStart)
+
+	for off := int64(0); off < sz; {
+		start, end, err := nextExtent(s, off, sz)
+		if err != nil {
+			return err
+		}
+
+		if start < end {
+			if err = fp(start, end); err != nil {
+				return err
+			}
+		}
+		off = end
+	}
 	return nil
 }
+
+// nextExtent returns the next region [start, end) of data at or after
+// 'off' in a file of size 'sz'. File systems that don't support
+// SEEK_DATA report the entire file as data.
+func nextExtent(fd int, off, sz int64) (int64, int64, error) {
+	start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+	if err != nil {
+		switch {
+		case errors.Is(err, unix.ENXIO):
+			// no more data; rest of the file is a hole
+			return sz, sz, nil
+		case errors.Is(err, unix.EINVAL):
+			return off, sz, nil
+		}
+		return 0, 0, err
+	}
+
+	end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+	if err != nil {
+		if !errors.Is(err, unix.EINVAL) {
+			return 0, 0, err
+		}
+		end = sz
+	}
+	return min(start, sz), min(end, sz), nil
+}
@@ -14,21 +14,59 @@
 package fio
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"runtime/debug"
+	"syscall"
+	"unsafe"
 
 	"github.com/opencoff/go-mmap"
 )
 
-// Use mmap(2) to copy src to dst.
-func copyViaMmap(dst, src *os.File) error {
-	_, err := mmap.Reader(src, func(b []byte) error {
-		_, err := fullWrite(dst, b)
-		return err
+// Use mmap(2) to copy src to dst. We write the mapped bytes in chunks
+// so that the copy can be cancelled and throttled.
+func copyViaMmap(c *copier, dst, src *os.File) error {
+	st, err := src.Stat()
+	if err != nil {
+		return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+	}
+	c.begin(st.Size())
+
+	var off int64
+	_, err = mmapReader(src, func(b []byte) error {
+		for len(b) > 0 {
+			n := min(len(b), _ioChunkSize)
+			if _, err := fullWrite(dst, b[:n]); err != nil {
+				// the kernel can't read the mapped pages of a
+				// truncated file
+				if errors.Is(err, syscall.EFAULT) {
+					return ErrSourceChanged
+				}
+				return err
+			}
+			c.hash(b[:n])
+			c.drop(dst, nil, off, int64(n))
+			off += int64(n)
+			c.used(COPY_MMAP, int64(n))
+			if err := c.update(int64(n)); err != nil {
+				return err
+			}
+			b = b[n:]
+		}
+		return nil
 	})
 	if err != nil {
 		return &CopyError{"mmap-reader", src.Name(), dst.Name(), err}
 	}
+	c.hashed = true
+
+	// the mapped pages of src can only be evicted once they're unmapped
+	if c.cache != CACHE_DEFAULT {
+		sysDropCache(src, 0, st.Size(), false)
+	}
+
 	_, err = dst.Seek(0, os.SEEK_SET)
 	if err != nil {
 		return &CopyError{"seek-mmap", src.Name(), dst.Name(), err}
@@ -40,8 +78,66 @@ func copyViaMmap(dst, src *os.File) error {
 	return nil
 }
 
-// slowCopy copies src to dst via mmap
-func slowCopy(dst, src string, perm fs.FileMode) error {
+// mmapReader is like mmap.Reader() except that a fault while accessing
+// the mapped file is returned as ErrSourceChanged instead of crashing
+// the process. Accessing the mapped pages of a file that is truncated
+// underneath us raises SIGBUS; the runtime turns it into a panic that
+// we recover here.
+func mmapReader(fd *os.File, fp func(b []byte) error) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("mmap: %w", err)
+	}
+
+	m := mmap.New(fd)
+	sz := st.Size()
+
+	var off int64
+	for off < sz {
+		n := min(sz-off, mmap.MaxMappingSize)
+		if err = mmapChunk(m, off, n, fp); err != nil {
+			return off, err
+		}
+		off += n
+	}
+	return off, nil
+}
+
+// map 'n' bytes of the file at 'off' and call 'fp' with the mapped
+// bytes. The mapping is unmapped even if 'fp' faults; faults outside
+// the mapping aren't ours to recover and we panic again.
+func mmapChunk(m *mmap.Mmap, off, n int64, fp func(b []byte) error) (err error) {
+	p, err := m.Map(n, off, mmap.PROT_READ, mmap.F_READAHEAD)
+	if err != nil {
+		return err
+	}
+
+	defer p.Unmap()
+
+	b := p.Bytes()
+	old := debug.SetPanicOnFault(true)
+	defer func() {
+		debug.SetPanicOnFault(old)
+		if r := recover(); r != nil {
+			f, ok := r.(interface{ Addr() uintptr })
+			if !ok || !within(f.Addr(), b) {
+				panic(r)
+			}
+			err = ErrSourceChanged
+		}
+	}()
+
+	return fp(b)
+}
+
+// within returns true if the address 'a' is inside 'b'
+func within(a uintptr, b []byte) bool {
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	return a >= start && a < start+uintptr(len(b))
+}
+
+// slowCopy copies src to dst without any CoW facilities
+func slowCopy(c *copier, dst, src string, perm fs.FileMode) error {
 	s, err := os.Open(src)
 	if err != nil {
 		return &CopyError{"open-src", src, dst, err}
@@ -56,7 +152,7 @@ func slowCopy(dst, src string, perm fs.FileMode) error {
 
 	defer d.Abort()
 
-	if err = copyViaMmap(d.File, s); err != nil {
+	if err = copyFd(c, d.File, s); err != nil {
 		return err
 	}
 
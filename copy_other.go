@@ -20,10 +20,10 @@ import (
 	"os"
 )
 
-func sysCopyFile(dst, src string, perm fs.FileMode) error {
-	return slowCopy(dst, src, perm)
+func sysCopyFile(c *copier, dst, src string, perm fs.FileMode) error {
+	return slowCopy(c, dst, src, perm)
 }
 
-func sysCopyFd(dst, src *os.File) error {
-	return copyViaMmap(dst, src)
+func sysCopyFd(c *copier, dst, src *os.File) error {
+	return copyFallback(c, dst, src)
 }
@@ -0,0 +1,128 @@
+// copy_parallel.go - copy large files by concurrently copying ranges
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Smallest range that is copied by a single worker
+const _minRangeSize int64 = 8 * 1024 * 1024
+
+// a range of bytes to copy
+type fileRange struct {
+	off, n int64
+}
+
+// tryParallel copies the first 'sz' bytes of src to dst in parallel if
+// the file is large enough. It returns false if the caller must copy
+// the file some other way.
+func tryParallel(c *copier, dst, src *os.File, sz int64) (bool, error) {
+	if !c.parallel(sz) {
+		return false, nil
+	}
+
+	ranged := _haveCopyRange && c.allow(COPY_RANGE)
+	err := copyParallel(c, dst, src, sz, ranged)
+	if err == nil || c.ctx.Err() != nil {
+		return true, err
+	}
+
+	// copy_file_range(2) can't copy these files; the ranges copied so
+	// far are identical to the source and the serial methods
+	// overwrite them.
+	if !ranged || !errAny(err, errNoCopyRange...) {
+		return true, err
+	}
+
+	c.rewind()
+	c.methods &^= COPY_RANGE
+	return false, nil
+}
+
+// copyParallel splits the data regions in the first 'sz' bytes of src
+// into ranges and copies them concurrently to dst; the holes of a sparse
+// source are skipped. Each range is copied via copy_file_range(2) if
+// 'ranged' is true and pread(2)/pwrite(2) otherwise.
+func copyParallel(c *copier, dst, src *os.File, sz int64, ranged bool) error {
+	fp := copyRW
+	if ranged {
+		fp = copyRangeAt
+	}
+
+	// the ranges complete out of order; we can't compute a running
+	// checksum. c.check() will re-read the source.
+	c.sum = nil
+	c.hashed = false
+
+	// we want a few ranges per worker to smooth out the differences
+	// in their progress
+	rsz := max(sz/int64(4*c.ncpu), _minRangeSize)
+	rsz = (rsz + int64(_ioChunkSize) - 1) / int64(_ioChunkSize) * int64(_ioChunkSize)
+
+	// there's no point copying the other ranges if one of them fails
+	wp := NewWorkPoolContext[fileRange](c.ctx, c.ncpu, func(_ context.Context, _ int, r fileRange) error {
+		return fp(c, dst, src, r.off, r.n)
+	}, WithFailFast(true))
+
+	go func() {
+		defer wp.Close()
+
+		var prev int64
+		err := dataExtents(src, sz, func(start, end int64) error {
+			if start > prev {
+				if err := c.hole(start - prev); err != nil {
+					return err
+				}
+			}
+
+			for off := start; off < end; off += rsz {
+				if err := wp.Submit(fileRange{off, min(rsz, end-off)}); err != nil {
+					return err
+				}
+			}
+			prev = end
+			return nil
+		})
+
+		if err == nil && sz > prev {
+			err = c.hole(sz - prev)
+		}
+
+		// a failed submit means the pool already has an error
+		if err != nil && c.ctx.Err() == nil && wp.ctx.Err() == nil {
+			wp.Err(&CopyError{"seek-data", src.Name(), dst.Name(), err})
+		}
+	}()
+
+	if err := wp.Wait(); err != nil {
+		return err
+	}
+
+	if err := c.ctx.Err(); err != nil {
+		return &CopyError{"cancel", src.Name(), dst.Name(), err}
+	}
+
+	// account for a trailing hole
+	if err := dst.Truncate(sz); err != nil {
+		return &CopyError{"truncate", src.Name(), dst.Name(), err}
+	}
+
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return &CopyError{"seek", src.Name(), dst.Name(), err}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+// copy_reader.go - copy from io.Reader and fs.FS sources
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// CopyReader copies the contents of 'r' to a new file 'dst' with
+// permissions 'perm'. The file is written via a SafeFile and committed
+// atomically only if the copy succeeds. If 'r' is a regular file, it is
+// copied like CopyFd(); if it is a pipe, the bytes are spliced into
+// 'dst' where the platform supports it. All other readers are copied
+// via a buffer. It returns the stats describing how the file was copied.
+func CopyReader(dst string, r io.Reader, perm fs.FileMode, opt ...CopyOption) (*CopyStats, error) {
+	c := newCopier(context.Background(), opt)
+	if err := copyReader(c, dst, r, readerName(r), perm); err != nil {
+		return nil, err
+	}
+	return c.finish(), nil
+}
+
+// CopyFS copies the file tree in 'fsys' to the directory 'dstDir'; the
+// directory is created if it doesn't exist. Each file is copied via
+// CopyReader() with the options in 'opt' and the permissions and
+// modification times from its fs.FileInfo are applied to the copy.
+// Only directories and regular files can be copied; any other file
+// type fails the copy. It returns the aggregate stats of all the
+// files that were copied.
+func CopyFS(dstDir string, fsys fs.FS, opt ...CopyOption) (*CopyStats, error) {
+	type dirInfo struct {
+		nm    string
+		mode  fs.FileMode
+		mtime time.Time
+	}
+
+	var dirs []dirInfo
+	var stats CopyStats
+
+	err := fs.WalkDir(fsys, ".", func(p string, de fs.DirEntry, err error) error {
+		dst := filepath.Join(dstDir, filepath.FromSlash(p))
+		if err != nil {
+			return &CopyError{"walk", p, dst, err}
+		}
+
+		fi, err := de.Info()
+		if err != nil {
+			return &CopyError{"stat-src", p, dst, err}
+		}
+
+		switch {
+		case fi.IsDir():
+			// we need to write to the dir before we fix its perms
+			if err := os.MkdirAll(dst, 0700); err != nil {
+				return &CopyError{"mkdir", p, dst, err}
+			}
+
+			// we don't modify the caller's dstDir
+			if p != "." {
+				dirs = append(dirs, dirInfo{dst, fi.Mode().Perm(), fi.ModTime()})
+			}
+
+		case fi.Mode().IsRegular():
+			st, err := copyFSFile(fsys, dst, p, fi, opt)
+			if err != nil {
+				return err
+			}
+			stats.Add(st)
+
+		default:
+			return &CopyError{"copyfs", p, dst,
+				fmt.Errorf("%w: file type %s", errors.ErrUnsupported, fi.Mode().Type())}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// children are fixed before their parents; otherwise we'd update
+	// the mtime of the parent or lose permission to write into it.
+	for _, d := range slices.Backward(dirs) {
+		if err := os.Chmod(d.nm, d.mode); err != nil {
+			return nil, &CopyError{"chmod", d.nm, d.nm, err}
+		}
+		if err := os.Chtimes(d.nm, time.Time{}, d.mtime); err != nil {
+			return nil, &CopyError{"utimes", d.nm, d.nm, err}
+		}
+	}
+
+	return &stats, nil
+}
+
+// copy the regular file 'p' in fsys to 'dst'
+func copyFSFile(fsys fs.FS, dst, p string, fi fs.FileInfo, opt []CopyOption) (*CopyStats, error) {
+	fd, err := fsys.Open(p)
+	if err != nil {
+		return nil, &CopyError{"open-src", p, dst, err}
+	}
+
+	defer fd.Close()
+
+	c := newCopier(context.Background(), opt)
+	if err = copyReader(c, dst, fd, p, fi.Mode().Perm()); err != nil {
+		return nil, err
+	}
+
+	// a zero mtime (eg embed.FS) leaves the time of the copy unchanged
+	if err = os.Chtimes(dst, time.Time{}, fi.ModTime()); err != nil {
+		return nil, &CopyError{"utimes", p, dst, err}
+	}
+	return c.finish(), nil
+}
+
+// copy 'r' to a new file 'dst'; 'snm' is the name of the source that
+// we use in errors.
+func copyReader(c *copier, dst string, r io.Reader, snm string, perm fs.FileMode) error {
+	d, err := NewSafeFile(dst, OPT_OVERWRITE, os.O_CREATE|os.O_RDWR|os.O_EXCL, perm)
+	if err != nil {
+		return &CopyError{"safefile", snm, dst, err}
+	}
+
+	defer d.Abort()
+
+	if err = copyReaderFd(c, d.File, r, snm); err != nil {
+		return err
+	}
+
+	// the umask may have masked some of the bits in perm
+	if err = d.Chmod(perm); err != nil {
+		return &CopyError{"chmod", snm, dst, err}
+	}
+
+	if err = d.Close(); err != nil {
+		return &CopyError{"close", snm, dst, err}
+	}
+	return nil
+}
+
+// copy 'r' to dst using the best primitive available for its type
+func copyReaderFd(c *copier, dst *os.File, r io.Reader, snm string) error {
+	// the size of 'r' is unknown unless it is a regular file
+	c.begin(-1)
+
+	if st, ok := r.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := st.Stat(); err == nil && fi.Mode().IsRegular() {
+			c.begin(fi.Size())
+		}
+	}
+
+	if fd, ok := r.(*os.File); ok {
+		// Fstat() needs a name in the file system; pipes don't have one
+		fi, err := fd.Stat()
+		if err != nil {
+			return &CopyError{"stat-src", snm, dst.Name(), err}
+		}
+
+		switch {
+		case fi.Mode().IsRegular():
+			// we copy whole files; a partially read file is a stream.
+			off, err := fd.Seek(0, io.SeekCurrent)
+			if err == nil && off == 0 {
+				return copyOpenFile(c, dst, fd)
+			}
+
+		case fi.Mode()&fs.ModeNamedPipe > 0:
+			// we can't compute a checksum for spliced bytes
+			if c.sum == nil && c.allow(COPY_SPLICE) {
+				err = sysSplice(c, dst, fd)
+				if err == nil {
+					return nil
+				}
+
+				// we can only fallback if nothing was copied
+				if c.stats.Bytes > 0 || !errAny(err, errNoSplice...) {
+					return err
+				}
+			}
+		}
+	}
+
+	if !c.allow(COPY_RW) {
+		return &CopyError{"copy", snm, dst.Name(), ErrNoCopyMethod}
+	}
+
+	if err := copyStream(c, dst, r, snm); err != nil {
+		return err
+	}
+
+	if c.verify {
+		return checkSum(dst, snm, c.sum.Sum(nil))
+	}
+	return nil
+}
+
+// copy the regular file src to dst. The same file system restrictions
+// as sysCopyFile() apply.
+func copyOpenFile(c *copier, dst, src *os.File) error {
+	si, err := Fstat(src)
+	if err != nil {
+		return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+	}
+
+	di, err := Fstat(dst)
+	if err != nil {
+		return &CopyError{"fstat-dst", src.Name(), dst.Name(), err}
+	}
+
+	if !di.IsSameFS(si) {
+		c.methods &= COPY_MMAP | COPY_RW
+	}
+	return copyFd(c, dst, src)
+}
+
+// copy 'r' to dst via a buffer until we see EOF
+func copyStream(c *copier, dst *os.File, r io.Reader, snm string) error {
+	var off int64
+
+	buf := make([]byte, _ioChunkSize)
+	for {
+		m, err := r.Read(buf)
+		if m > 0 {
+			b := buf[:m]
+			if _, err := fullWrite(dst, b); err != nil {
+				return &CopyError{"write", snm, dst.Name(), err}
+			}
+
+			c.hash(b)
+			c.drop(dst, nil, off, int64(m))
+			c.used(COPY_RW, int64(m))
+			off += int64(m)
+			if err := c.update(int64(m)); err != nil {
+				return &CopyError{"cancel", snm, dst.Name(), err}
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &CopyError{"read", snm, dst.Name(), err}
+		}
+	}
+	c.hashed = true
+
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return &CopyError{"seek", snm, dst.Name(), err}
+	}
+	return nil
+}
+
+// readerName returns a printable name for 'r'
+func readerName(r io.Reader) string {
+	if n, ok := r.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", r)
+}
@@ -0,0 +1,272 @@
+// copy_resume.go - resumable file copies with on-disk checkpoints
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// A resumable copy writes to a well known partial file (see
+// PartialName()) and periodically records its progress in a
+// checkpoint file next to it. The checkpoint identifies the source
+// and the number of bytes of the partial file that are synced to disk.
+// A subsequent copy of the same src and dst compares those bytes with
+// the source if it hasn't changed in the interim, and resumes after
+// the longest prefix that matches. The partial file is locked while a
+// copy is writing to it.
+
+const (
+	// default interval between checkpoints
+	_CheckpointInterval int64 = 64 * 1024 * 1024
+
+	// 1b for version, 8b for each of dev, ino, size, mtime, done
+	_CheckpointSize int = 1 + (5 * 8)
+
+	// increment this when we change the checkpoint encoding
+	checkpointVersion byte = 1
+)
+
+// checkpoint records the progress of a resumable copy
+type checkpoint struct {
+	// identity of the source
+	Dev  uint64
+	Ino  uint64
+	Siz  int64
+	Mtim time.Time
+
+	// bytes of the destination that are synced to disk
+	Done int64
+}
+
+func newCheckpoint(fi *Info) *checkpoint {
+	ck := &checkpoint{
+		Dev:  fi.Dev,
+		Ino:  fi.Ino,
+		Siz:  fi.Siz,
+		Mtim: fi.Mtim,
+	}
+	return ck
+}
+
+// same returns true if the source described by 'fi' is identical
+// to the one recorded in this checkpoint
+func (ck *checkpoint) same(fi *Info) bool {
+	return ck.Dev == fi.Dev && ck.Ino == fi.Ino &&
+		ck.Siz == fi.Siz && ck.Mtim.Equal(fi.Mtim)
+}
+
+func (ck *checkpoint) marshal() []byte {
+	buf := make([]byte, _CheckpointSize)
+
+	b := buf
+	b[0], b = checkpointVersion, b[1:]
+	b = enc64(b, ck.Dev)
+	b = enc64(b, ck.Ino)
+	b = enc64(b, ck.Siz)
+	b = enctime(b, ck.Mtim)
+	enc64(b, ck.Done)
+	return buf
+}
+
+func (ck *checkpoint) unmarshal(b []byte) error {
+	if len(b) < _CheckpointSize {
+		return fmt.Errorf("unmarshal: checkpoint: %w", ErrTooSmall)
+	}
+
+	if b[0] != checkpointVersion {
+		return fmt.Errorf("unmarshal: checkpoint: unsupported version %d", b[0])
+	}
+
+	b = b[1:]
+	b, ck.Dev = dec64[uint64](b)
+	b, ck.Ino = dec64[uint64](b)
+	b, ck.Siz = dec64[int64](b)
+	b, ck.Mtim = dectime(b)
+	_, ck.Done = dec64[int64](b)
+	return nil
+}
+
+// write the checkpoint atomically to file 'nm'
+func (ck *checkpoint) write(nm string) error {
+	sf, err := NewSafeFile(nm, OPT_OVERWRITE, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer sf.Abort()
+
+	if _, err = sf.Write(ck.marshal()); err != nil {
+		return err
+	}
+	return sf.Close()
+}
+
+func readCheckpoint(nm string) (*checkpoint, error) {
+	b, err := os.ReadFile(nm)
+	if err != nil {
+		return nil, err
+	}
+
+	ck := &checkpoint{}
+	if err = ck.unmarshal(b); err != nil {
+		return nil, err
+	}
+	return ck, nil
+}
+
+// checkpointName returns the name of the checkpoint file for
+// a resumable copy to 'dst'
+func checkpointName(dst string) string {
+	return PartialName(dst) + ".ckpt"
+}
+
+// resumeCopy copies src to dst while recording its progress so that
+// an interrupted copy can be resumed later.
+func resumeCopy(c *copier, dst, src string, perm fs.FileMode) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return &CopyError{"open-src", src, dst, err}
+	}
+
+	defer s.Close()
+
+	si, err := Fstat(s)
+	if err != nil {
+		return &CopyError{"stat-src", src, dst, err}
+	}
+
+	d, err := NewSafeFile(dst, OPT_OVERWRITE|OPT_RESUME, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return &CopyError{"safefile", src, dst, err}
+	}
+
+	// this retains the partial file for the next attempt
+	defer d.Abort()
+
+	di, err := Fstat(d.File)
+	if err != nil {
+		return &CopyError{"fstat-dst", src, dst, err}
+	}
+
+	fp := copyRW
+	switch {
+	case _haveCopyRange && c.allow(COPY_RANGE) && di.IsSameFS(si):
+		fp = copyRangeAt
+	case !c.allow(COPY_RW):
+		return &CopyError{"copy", src, dst, ErrNoCopyMethod}
+	}
+
+	sz := si.Size()
+	c.begin(sz)
+
+	// we resume only if the source is unchanged and the partial
+	// file has all the bytes recorded in the checkpoint.
+	ckname := checkpointName(dst)
+	ck := newCheckpoint(si)
+	if old, err := readCheckpoint(ckname); err == nil {
+		if old.same(si) && old.Done <= di.Size() {
+			ck.Done = old.Done
+		}
+	}
+
+	// we trust only the bytes that match the source
+	if ck.Done, err = verifiedPrefix(c, d.File, s, ck.Done); err != nil {
+		return err
+	}
+
+	// discard anything past the verified bytes
+	if err = d.Truncate(ck.Done); err != nil {
+		return &CopyError{"truncate", src, dst, err}
+	}
+
+	if err = c.preallocate(d.File, s, sz); err != nil {
+		return err
+	}
+
+	if err = c.skip(ck.Done); err != nil {
+		return &CopyError{"cancel", src, dst, err}
+	}
+
+	// we don't see all the bytes of the source; c.check() will
+	// re-read it.
+	c.sum = nil
+	c.hashed = false
+
+	for ck.Done < sz {
+		n := min(c.ckpt, sz-ck.Done)
+		if err = fp(c, d.File, s, ck.Done, n); err != nil {
+			return err
+		}
+
+		if err = d.Sync(); err != nil {
+			return &CopyError{"dst-sync", src, dst, err}
+		}
+
+		ck.Done += n
+		if err = ck.write(ckname); err != nil {
+			return &CopyError{"checkpoint", src, dst, err}
+		}
+	}
+
+	if err = c.check(d.File, s); err != nil {
+		// the partial file can't be trusted; start afresh next time
+		os.Remove(ckname)
+		d.Truncate(0)
+		return err
+	}
+
+	if err = d.Close(); err != nil {
+		return &CopyError{"close", src, dst, err}
+	}
+
+	os.Remove(ckname)
+	return nil
+}
+
+// verifiedPrefix returns the number of bytes at the start of dst that
+// match src; at most 'n' bytes are compared.
+func verifiedPrefix(c *copier, dst, src *os.File, n int64) (int64, error) {
+	a := make([]byte, min(int64(_ioChunkSize), n))
+	b := make([]byte, len(a))
+
+	var off int64
+	for off < n {
+		if err := c.ctx.Err(); err != nil {
+			return 0, &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
+
+		z := int(min(int64(len(a)), n-off))
+		if _, err := src.ReadAt(a[:z], off); err != nil {
+			return 0, &CopyError{"read", src.Name(), dst.Name(), err}
+		}
+		if _, err := dst.ReadAt(b[:z], off); err != nil {
+			return 0, &CopyError{"read-dst", src.Name(), dst.Name(), err}
+		}
+
+		if !bytes.Equal(a[:z], b[:z]) {
+			// resume from the first byte that differs
+			for i := range z {
+				if a[i] != b[i] {
+					return off + int64(i), nil
+				}
+			}
+		}
+		off += int64(z)
+	}
+	return off, nil
+}
@@ -0,0 +1,70 @@
+// copy_rw.go - copy using plain read(2) and write(2)
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"io"
+	"os"
+)
+
+// copy src to dst via a buffer; this is the most portable way
+// of copying files.
+func copyViaRW(c *copier, dst, src *os.File) error {
+	st, err := src.Stat()
+	if err != nil {
+		return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+	}
+
+	sz := st.Size()
+	c.begin(sz)
+
+	if err = copyRW(c, dst, src, 0, sz); err != nil {
+		return err
+	}
+	c.hashed = true
+
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return &CopyError{"seek", src.Name(), dst.Name(), err}
+	}
+	return nil
+}
+
+// copy 'n' bytes at offset 'off' from src to dst using pread(2)
+// and pwrite(2). The file offsets of src and dst are unchanged; so
+// this is safe to call concurrently for non-overlapping ranges.
+func copyRW(c *copier, dst, src *os.File, off, n int64) error {
+	buf := make([]byte, min(int64(_ioChunkSize), n))
+	for n > 0 {
+		b := buf[:min(int64(len(buf)), n)]
+		m, err := src.ReadAt(b, off)
+		if err != nil && !(err == io.EOF && m == len(b)) {
+			return &CopyError{"read", src.Name(), dst.Name(), err}
+		}
+
+		if _, err = dst.WriteAt(b, off); err != nil {
+			return &CopyError{"write", src.Name(), dst.Name(), err}
+		}
+
+		c.hash(b)
+		c.drop(dst, src, off, int64(m))
+		c.used(COPY_RW, int64(m))
+		if err = c.update(int64(m)); err != nil {
+			return &CopyError{"cancel", src.Name(), dst.Name(), err}
+		}
+
+		off += int64(m)
+		n -= int64(m)
+	}
+	return nil
+}
@@ -14,10 +14,21 @@
 package fio
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestCopyFile(t *testing.T) {
@@ -38,6 +49,753 @@ func TestCopyFile(t *testing.T) {
 	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
 }
 
+func TestCopyFileProgress(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	src := filepath.Join(tmpdir, "file-a")
+	dst := filepath.Join(tmpdir, "file-b")
+
+	srcsum, err := createFile(src, 1024*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	var done, total int64
+	progress := func(d, t int64) {
+		done, total = d, t
+	}
+
+	ctx := context.Background()
+	_, err = CopyFileContext(ctx, dst, src, 0600, WithProgress(0, progress))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(total == 1024*1024, "progress: exp total %d, saw %d", 1024*1024, total)
+	assert(done == total, "progress: exp done %d, saw %d", total, done)
+
+	dstsum, err := fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+}
+
+func TestCopyFileCancel(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	src := filepath.Join(tmpdir, "file-a")
+	dst := filepath.Join(tmpdir, "file-b")
+
+	_, err := createFile(src, 4*1024*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	// throttle the copy so that it can't possibly finish before
+	// the deadline. We use the mmap copier directly so that a
+	// reflink on a CoW filesystem doesn't finish the copy instantly.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	s, err := os.Open(src)
+	assert(err == nil, "open %s: %s", src, err)
+	defer s.Close()
+
+	d, err := NewSafeFile(dst, OPT_OVERWRITE, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
+	assert(err == nil, "safefile %s: %s", dst, err)
+	defer d.Abort()
+
+	err = copyViaMmap(newCopier(ctx, []CopyOption{WithRateLimit(1024 * 1024)}), d.File, s)
+	assert(errors.Is(err, context.DeadlineExceeded), "copy: exp deadline exceeded, saw %v", err)
+	d.Abort()
+
+	_, err = os.Stat(dst)
+	assert(errors.Is(err, os.ErrNotExist), "%s: partial file committed", dst)
+
+	_, err = CopyFileContext(ctx, dst, src, 0600)
+	assert(errors.Is(err, context.DeadlineExceeded), "copy: exp deadline exceeded, saw %v", err)
+}
+
+func TestCopyFileMethods(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	src := filepath.Join(tmpdir, "file-a")
+	srcsum, err := createFile(src, 512*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	ctx := context.Background()
+	methods := []CopyMethod{COPY_MMAP, COPY_ALL &^ COPY_REFLINK}
+	for i, m := range methods {
+		dst := filepath.Join(tmpdir, fmt.Sprintf("file-b.%d", i))
+		st, err := CopyFileContext(ctx, dst, src, 0600, WithCopyMethods(m))
+		assert(err == nil, "copy %s to %s: %s", src, dst, err)
+		assert(st.Method&^m == 0, "%s: exp method %s, saw %s", dst, m, st.Method)
+		assert(st.Reflinked == 0, "%s: exp no reflinks, saw %d", dst, st.Reflinked)
+		assert(st.Bytes == 512*1024, "%s: exp 512k bytes, saw %d", dst, st.Bytes)
+
+		dstsum, err := fileCksum(dst)
+		assert(err == nil, "cksum %s: %s", dst, err)
+		assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+	}
+
+	dst := filepath.Join(tmpdir, "file-c")
+	_, err = CopyFileContext(ctx, dst, src, 0600, WithCopyMethods(0))
+	assert(errors.Is(err, ErrNoCopyMethod), "copy: exp ErrNoCopyMethod, saw %v", err)
+}
+
+func TestCopyFileSparse(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("sparse copies are only supported on linux")
+	}
+
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	src := filepath.Join(tmpdir, "file-a")
+	dst := filepath.Join(tmpdir, "file-b")
+
+	// 1M hole, 64k data, 1M hole
+	const hole int64 = 1024 * 1024
+	buf := randbuf(make([]byte, 65536))
+
+	fd, err := os.OpenFile(src, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	assert(err == nil, "create %s: %s", src, err)
+	_, err = fd.WriteAt(buf, hole)
+	assert(err == nil, "write %s: %s", src, err)
+	err = fd.Truncate(2*hole + int64(len(buf)))
+	assert(err == nil, "truncate %s: %s", src, err)
+	err = fd.Close()
+	assert(err == nil, "close %s: %s", src, err)
+
+	srcsum, err := fileCksum(src)
+	assert(err == nil, "cksum %s: %s", src, err)
+
+	st, err := CopyFileContext(context.Background(), dst, src, 0600, WithCopyMethods(COPY_RANGE))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Method == COPY_RANGE, "exp copy-range, saw %s", st.Method)
+	assert(st.Holes > 0, "exp holes to be skipped: %s", st)
+	assert(st.Bytes+st.Holes == 2*hole+int64(len(buf)), "size mismatch: %s", st)
+
+	dstsum, err := fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+
+	// parallel and O_DIRECT copies skip the holes too
+	opts := [][]CopyOption{
+		{WithCopyMethods(COPY_RANGE), WithParallel(1, 4)},
+		{WithCopyMethods(COPY_RW), WithParallel(1, 4)},
+		{WithCopyMethods(COPY_RW), WithCacheMode(CACHE_DIRECT)},
+	}
+	for i, opt := range opts {
+		dst := filepath.Join(tmpdir, fmt.Sprintf("file-c.%d", i))
+		st, err := CopyFileContext(context.Background(), dst, src, 0600, append(opt, WithVerify(true))...)
+		assert(err == nil, "copy %s to %s: %s", src, dst, err)
+
+		m := st.Method
+		assert(st.Bytes == int64(len(buf)), "%s: exp %d bytes, saw %s", m, len(buf), st)
+		assert(st.Holes == 2*hole, "%s: exp %d holes, saw %s", m, 2*hole, st)
+
+		fi, err := os.Stat(dst)
+		assert(err == nil, "stat %s: %s", dst, err)
+		blks := fi.Sys().(*syscall.Stat_t).Blocks
+		assert(blks*512 < 2*hole, "%s: holes were filled: %d blocks", m, blks)
+
+		dstsum, err := fileCksum(dst)
+		assert(err == nil, "cksum %s: %s", dst, err)
+		assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+	}
+}
+
+func TestCopyFilePrealloc(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("preallocation is only supported on linux")
+	}
+
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	// a sparse file: 1M hole, 64k data, 1M hole
+	const hole int64 = 1024 * 1024
+	buf := randbuf(make([]byte, 65536))
+	sz := 2*hole + int64(len(buf))
+
+	src := filepath.Join(tmpdir, "file-a")
+	fd, err := os.OpenFile(src, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	assert(err == nil, "create %s: %s", src, err)
+	_, err = fd.WriteAt(buf, hole)
+	assert(err == nil, "write %s: %s", src, err)
+	err = fd.Truncate(sz)
+	assert(err == nil, "truncate %s: %s", src, err)
+	err = fd.Close()
+	assert(err == nil, "close %s: %s", src, err)
+
+	srcsum, err := fileCksum(src)
+	assert(err == nil, "cksum %s: %s", src, err)
+
+	ctx := context.Background()
+	for i, m := range []CopyMethod{COPY_RANGE, COPY_RW} {
+		dst := filepath.Join(tmpdir, fmt.Sprintf("file-b.%d", i))
+		_, err := CopyFileContext(ctx, dst, src, 0600, WithCopyMethods(m), WithPrealloc(true))
+		assert(err == nil, "copy %s to %s: %s", src, dst, err)
+
+		fi, err := os.Stat(dst)
+		assert(err == nil, "stat %s: %s", dst, err)
+		assert(fi.Size() == sz, "%s: exp size %d, saw %d", m, sz, fi.Size())
+
+		dstsum, err := fileCksum(dst)
+		assert(err == nil, "cksum %s: %s", dst, err)
+		assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+
+		// the holes must not be allocated
+		if m == COPY_RANGE {
+			st := fi.Sys().(*syscall.Stat_t)
+			assert(st.Blocks*512 < sz, "%s: holes were filled: %d blocks", m, st.Blocks)
+		}
+	}
+}
+
+func TestCopyFileTruncated(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	ctx := context.Background()
+	for i, verify := range []bool{false, true} {
+		src := filepath.Join(tmpdir, fmt.Sprintf("file-a.%d", i))
+		dst := filepath.Join(tmpdir, fmt.Sprintf("file-b.%d", i))
+		_, err := createFile(src, 4*1024*1024)
+		assert(err == nil, "create %s: %s", src, err)
+
+		// truncate the source after the first chunk is copied
+		trunc := func(done, total int64) {
+			if done > 0 && done < total {
+				os.Truncate(src, 0)
+			}
+		}
+
+		_, err = CopyFileContext(ctx, dst, src, 0600, WithCopyMethods(COPY_MMAP),
+			WithVerify(verify), WithProgress(0, trunc))
+		assert(errors.Is(err, ErrSourceChanged), "exp ErrSourceChanged, saw %v", err)
+
+		_, err = os.Stat(dst)
+		assert(os.IsNotExist(err), "%s: exp to not exist, saw %v", dst, err)
+	}
+
+	// a source that grows is copied up to its original size; it's
+	// left to WithSourceCheck() to detect it.
+	src := filepath.Join(tmpdir, "file-grow")
+	dst := filepath.Join(tmpdir, "file-grow.dst")
+	_, err := createFile(src, 4*1024*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	var grown bool
+	grow := func(done, total int64) {
+		if done > 0 && !grown {
+			grown = true
+			fd, err := os.OpenFile(src, os.O_WRONLY|os.O_APPEND, 0)
+			assert(err == nil, "open %s: %s", src, err)
+			fd.Write(make([]byte, 4096))
+			fd.Close()
+		}
+	}
+
+	_, err = CopyFileContext(ctx, dst, src, 0600, WithCopyMethods(COPY_MMAP), WithProgress(0, grow))
+	assert(err == nil, "copy: %s", err)
+	fi, err := os.Stat(dst)
+	assert(err == nil, "stat %s: %s", dst, err)
+	assert(fi.Size() == 4*1024*1024, "%s: exp %d bytes, saw %d", dst, 4*1024*1024, fi.Size())
+
+	// touching the pages of a truncated file must not crash us
+	src = filepath.Join(tmpdir, "file-c")
+	_, err = createFile(src, 1024*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	fd, err := os.Open(src)
+	assert(err == nil, "open %s: %s", src, err)
+	defer fd.Close()
+
+	var sum byte
+	_, err = mmapReader(fd, func(b []byte) error {
+		os.Truncate(src, 0)
+		for i := range b {
+			sum += b[i]
+		}
+		return nil
+	})
+	assert(errors.Is(err, ErrSourceChanged), "mmap: exp ErrSourceChanged, saw %v", err)
+
+	// faults outside the mapping are not a changed source
+	_, err = createFile(src, 1024*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	var r any
+	func() {
+		defer func() {
+			r = recover()
+		}()
+
+		var p *int
+		mmapReader(fd, func(b []byte) error {
+			*p = int(b[0])
+			return nil
+		})
+	}()
+	assert(r != nil, "mmap: exp a panic for a nil dereference")
+}
+
+func TestCopyFileSourceCheck(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	src := filepath.Join(tmpdir, "file-a")
+	_, err := createFile(src, 1024*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	// append to src the first 'n' times we see progress
+	grow := func(n int) func(done, total int64) {
+		return func(done, total int64) {
+			if n > 0 && done > 0 && done < total {
+				n--
+				fd, err := os.OpenFile(src, os.O_WRONLY|os.O_APPEND, 0600)
+				if err == nil {
+					fd.Write([]byte("x"))
+					fd.Close()
+				}
+			}
+		}
+	}
+
+	ctx := context.Background()
+	meth := WithCopyMethods(COPY_RW)
+
+	// the first attempt sees a change; the retry doesn't
+	dst := filepath.Join(tmpdir, "file-b")
+	st, err := CopyFileContext(ctx, dst, src, 0600, meth, WithVerify(true),
+		WithSourceCheck(2, false), WithProgress(0, grow(1)))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Retries == 1, "exp 1 retry, saw %s", st)
+
+	// only the retry is counted
+	fi, err := os.Stat(src)
+	assert(err == nil, "stat %s: %s", src, err)
+	assert(st.Bytes == fi.Size(), "exp %d bytes, saw %s", fi.Size(), st)
+	assert(st.Inconsistent == 0, "exp consistent copy, saw %s", st)
+
+	srcsum, err := fileCksum(src)
+	assert(err == nil, "cksum %s: %s", src, err)
+	dstsum, err := fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+
+	// src keeps changing; we don't commit the copy
+	dst = filepath.Join(tmpdir, "file-c")
+	_, err = CopyFileContext(ctx, dst, src, 0600, meth,
+		WithSourceCheck(2, false), WithProgress(0, grow(100)))
+	assert(errors.Is(err, ErrSourceChanged), "exp ErrSourceChanged, saw %v", err)
+
+	_, err = os.Stat(dst)
+	assert(os.IsNotExist(err), "%s: exp to not exist, saw %v", dst, err)
+
+	// .. unless we're asked to
+	st, err = CopyFileContext(ctx, dst, src, 0600, meth,
+		WithSourceCheck(2, true), WithProgress(0, grow(100)))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Retries == 2, "exp 2 retries, saw %s", st)
+	assert(st.Inconsistent == 1, "exp inconsistent copy, saw %s", st)
+
+	_, err = os.Stat(dst)
+	assert(err == nil, "%s: exp to exist, saw %v", dst, err)
+}
+
+func TestCopyFileVerify(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	src := filepath.Join(tmpdir, "file-a")
+	_, err := createFile(src, 512*1024)
+	assert(err == nil, "create %s: %s", src, err)
+
+	ctx := context.Background()
+	for i, m := range []CopyMethod{COPY_MMAP, COPY_ALL} {
+		dst := filepath.Join(tmpdir, fmt.Sprintf("file-b.%d", i))
+		_, err := CopyFileContext(ctx, dst, src, 0600, WithVerify(true), WithCopyMethods(m))
+		assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	}
+
+	// now corrupt a dst and make sure we detect it
+	dst := filepath.Join(tmpdir, "file-c")
+	_, err = createFile(dst, 512*1024)
+	assert(err == nil, "create %s: %s", dst, err)
+
+	s, err := os.Open(src)
+	assert(err == nil, "open %s: %s", src, err)
+	defer s.Close()
+
+	d, err := os.OpenFile(dst, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", dst, err)
+	defer d.Close()
+
+	c := newCopier(ctx, []CopyOption{WithVerify(true)})
+	err = c.check(d, s)
+
+	var cerr *CopyError
+	assert(errors.As(err, &cerr), "verify: exp CopyError, saw %v", err)
+	assert(cerr.Op == "verify", "verify: exp op verify, saw %s", cerr.Op)
+	assert(errors.Is(err, ErrVerify), "verify: exp ErrVerify, saw %v", err)
+}
+
+func TestCopyFileParallel(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	const size int = 20*1024*1024 + 4093
+
+	src := filepath.Join(tmpdir, "file-a")
+	srcsum, err := createFile(src, size)
+	assert(err == nil, "create %s: %s", src, err)
+
+	ctx := context.Background()
+	for i, m := range []CopyMethod{COPY_RW, COPY_RANGE | COPY_RW} {
+		dst := filepath.Join(tmpdir, fmt.Sprintf("file-b.%d", i))
+
+		var done int64
+		progress := func(d, _ int64) {
+			done = d
+		}
+
+		st, err := CopyFileContext(ctx, dst, src, 0600, WithCopyMethods(m),
+			WithParallel(1024*1024, 4), WithVerify(true), WithProgress(0, progress))
+		assert(err == nil, "copy %s to %s: %s", src, dst, err)
+		assert(st.Method&^m == 0, "%s: exp method %s, saw %s", dst, m, st.Method)
+		assert(st.Bytes == int64(size), "%s: exp %d bytes, saw %d", dst, size, st.Bytes)
+		assert(done == int64(size), "%s: exp %d progress, saw %d", dst, size, done)
+
+		dstsum, err := fileCksum(dst)
+		assert(err == nil, "cksum %s: %s", dst, err)
+		assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+	}
+}
+
+func TestCopyFileResume(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	const size int64 = 4 * 1024 * 1024
+	const ckpt int64 = 256 * 1024
+
+	src := filepath.Join(tmpdir, "file-a")
+	dst := filepath.Join(tmpdir, "file-b")
+
+	srcsum, err := createFile(src, int(size))
+	assert(err == nil, "create %s: %s", src, err)
+
+	// interrupt the first attempt midway
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err = CopyFileContext(ctx, dst, src, 0600, WithResume(ckpt), WithRateLimit(4*1024*1024))
+	assert(errors.Is(err, context.DeadlineExceeded), "copy: exp deadline exceeded, saw %v", err)
+
+	_, err = os.Stat(dst)
+	assert(errors.Is(err, os.ErrNotExist), "%s: partial file committed", dst)
+
+	ck, err := readCheckpoint(checkpointName(dst))
+	assert(err == nil, "checkpoint: %s", err)
+	assert(ck.Done > 0 && ck.Done < size, "checkpoint: unexpected progress %d", ck.Done)
+
+	// a concurrent copy can't use the partial file
+	sf, err := NewSafeFile(dst, OPT_OVERWRITE|OPT_RESUME, os.O_CREATE|os.O_RDWR, 0600)
+	assert(err == nil, "safefile %s: %s", dst, err)
+	_, err = CopyFileContext(context.Background(), dst, src, 0600, WithResume(ckpt))
+	assert(errors.Is(err, ErrPartialInUse), "copy: exp ErrPartialInUse, saw %v", err)
+	sf.Abort()
+
+	// corrupt the partial file; we must resume from the first bad byte
+	bad := ck.Done / 2
+	fd, err := os.OpenFile(PartialName(dst), os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", PartialName(dst), err)
+	var b [1]byte
+	_, err = fd.ReadAt(b[:], bad)
+	assert(err == nil, "read %s: %s", PartialName(dst), err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b[:], bad)
+	assert(err == nil, "write %s: %s", PartialName(dst), err)
+	err = fd.Close()
+	assert(err == nil, "close %s: %s", PartialName(dst), err)
+
+	// now resume and make sure we don't start from scratch
+	var first int64 = -1
+	progress := func(d, _ int64) {
+		if first < 0 {
+			first = d
+		}
+	}
+
+	st, err := CopyFileContext(context.Background(), dst, src, 0600, WithResume(ckpt),
+		WithProgress(0, progress), WithVerify(true))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(first >= bad, "resume: exp progress from %d, saw %d", bad, first)
+	assert(st.Bytes == size-bad, "resume: exp %d bytes, saw %d", size-bad, st.Bytes)
+
+	dstsum, err := fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+
+	for _, nm := range []string{PartialName(dst), checkpointName(dst)} {
+		_, err = os.Stat(nm)
+		assert(errors.Is(err, os.ErrNotExist), "%s: not cleaned up", nm)
+	}
+}
+
+func TestCopyFileResumeChanged(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	const size int64 = 1024 * 1024
+
+	src := filepath.Join(tmpdir, "file-a")
+	dst := filepath.Join(tmpdir, "file-b")
+
+	_, err := createFile(src, int(size))
+	assert(err == nil, "create %s: %s", src, err)
+
+	// fake a checkpoint from a previous attempt for a different source
+	fi, err := Stat(src)
+	assert(err == nil, "stat %s: %s", src, err)
+
+	ck := newCheckpoint(fi)
+	ck.Mtim = ck.Mtim.Add(-time.Hour)
+	ck.Done = size / 2
+	err = ck.write(checkpointName(dst))
+	assert(err == nil, "checkpoint: %s", err)
+
+	_, err = createFile(PartialName(dst), int(size/2))
+	assert(err == nil, "create %s: %s", PartialName(dst), err)
+
+	st, err := CopyFileContext(context.Background(), dst, src, 0600, WithResume(0), WithVerify(true))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Bytes == size, "resume: exp %d bytes, saw %d", size, st.Bytes)
+}
+
+func TestCopyDelta(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	const blksz int = 4096
+	const size int = 64 * blksz
+
+	src := filepath.Join(tmpdir, "file-a")
+	dst := filepath.Join(tmpdir, "file-b")
+
+	_, err := createFile(dst, size)
+	assert(err == nil, "create %s: %s", dst, err)
+
+	old, err := os.ReadFile(dst)
+	assert(err == nil, "read %s: %s", dst, err)
+
+	// make src from dst: change 2 blocks and append a partial block
+	buf := slices.Clone(old)
+	randbuf(buf[3*blksz : 3*blksz+10])
+	randbuf(buf[40*blksz+100 : 41*blksz])
+	buf = append(buf, randbuf(make([]byte, 100))...)
+	err = os.WriteFile(src, buf, 0600)
+	assert(err == nil, "write %s: %s", src, err)
+	srcsum := cksum(buf)
+
+	// exercise the block differ on a plain copy of dst
+	s, err := os.Open(src)
+	assert(err == nil, "open %s: %s", src, err)
+	defer s.Close()
+
+	tmp := filepath.Join(tmpdir, "file-c")
+	err = CopyFile(tmp, dst, 0600)
+	assert(err == nil, "copy %s: %s", tmp, err)
+
+	d, err := os.OpenFile(tmp, os.O_RDWR, 0600)
+	assert(err == nil, "open %s: %s", tmp, err)
+	defer d.Close()
+
+	c := newCopier(context.Background(), []CopyOption{WithDelta(blksz), WithVerify(true)})
+	err = copyDelta(c, d, s, int64(len(buf)))
+	assert(err == nil, "delta %s: %s", tmp, err)
+	err = c.check(d, s)
+	assert(err == nil, "delta %s: %s", tmp, err)
+	assert(c.stats.Bytes == int64(2*blksz+100), "delta: exp %d bytes, saw %d", 2*blksz+100, c.stats.Bytes)
+
+	tmpsum, err := fileCksum(tmp)
+	assert(err == nil, "cksum %s: %s", tmp, err)
+	assert(byteEq(srcsum, tmpsum), "cksum mismatch: %s", tmp)
+
+	// and the full thing; this falls back to a full copy if dst
+	// can't be reflinked.
+	st, err := CopyFileContext(context.Background(), dst, src, 0600, WithDelta(blksz), WithVerify(true))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	if st.Method&COPY_DELTA > 0 {
+		assert(st.Bytes == int64(2*blksz+100), "delta: exp %d bytes, saw %d", 2*blksz+100, st.Bytes)
+	}
+
+	dstsum, err := fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+
+	// force the delta path on file systems that can't reflink
+	defer func(seed func(dst, src *os.File) error) {
+		deltaSeed = seed
+	}(deltaSeed)
+
+	deltaSeed = func(dst, src *os.File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	err = os.WriteFile(dst, old, 0600)
+	assert(err == nil, "write %s: %s", dst, err)
+
+	st, err = CopyFileContext(context.Background(), dst, src, 0600, WithDelta(blksz), WithVerify(true))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Method&COPY_DELTA > 0, "delta: exp COPY_DELTA, saw %s", st.Method)
+	assert(st.Bytes == int64(2*blksz+100), "delta: exp %d bytes, saw %d", 2*blksz+100, st.Bytes)
+
+	dstsum, err = fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+
+	// an identical dst is still updated via a delta
+	st, err = CopyFileContext(context.Background(), dst, src, 0600, WithDelta(blksz))
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Method&COPY_DELTA > 0, "delta: exp COPY_DELTA, saw %s", st.Method)
+	assert(st.Bytes == 0, "delta: exp 0 bytes, saw %d", st.Bytes)
+
+	// a delta copy can't be resumed
+	_, err = CopyFileContext(context.Background(), dst, src, 0600, WithDelta(blksz), WithResume(0))
+	assert(errors.Is(err, ErrDeltaResume), "delta: exp ErrDeltaResume, saw %v", err)
+}
+
+func TestCopyFileCache(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	ctx := context.Background()
+	for i, sz := range []int{1024 * 1024, 1024*1024 + 4097, 100} {
+		src := filepath.Join(tmpdir, fmt.Sprintf("file-a.%d", i))
+		srcsum, err := createFile(src, sz)
+		assert(err == nil, "create %s: %s", src, err)
+
+		for _, cm := range []CacheMode{CACHE_DROP, CACHE_DIRECT} {
+			for j, m := range []CopyMethod{COPY_MMAP | COPY_RW, COPY_ALL} {
+				dst := filepath.Join(tmpdir, fmt.Sprintf("file-b.%d.%s.%d", i, cm, j))
+				st, err := CopyFileContext(ctx, dst, src, 0600, WithCacheMode(cm),
+					WithCopyMethods(m), WithVerify(true))
+				assert(err == nil, "copy %s to %s: %s", src, dst, err)
+				assert(st.Method&COPY_MMAP == 0, "%s: exp no mmap, saw %s", cm, st.Method)
+
+				dstsum, err := fileCksum(dst)
+				assert(err == nil, "cksum %s: %s", dst, err)
+				assert(byteEq(srcsum, dstsum), "cksum mismatch: %s", dst)
+			}
+		}
+	}
+}
+
+func TestCopyReader(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	buf := randbuf(make([]byte, 1024*1024+37))
+	sum := cksum(buf)
+
+	// a plain reader
+	dst := filepath.Join(tmpdir, "file-a")
+	st, err := CopyReader(dst, bytes.NewReader(buf), 0640, WithVerify(true))
+	assert(err == nil, "copy reader to %s: %s", dst, err)
+	assert(st.Method == COPY_RW, "reader: exp read-write, saw %s", st.Method)
+	assert(st.Bytes == int64(len(buf)), "reader: exp %d bytes, saw %d", len(buf), st.Bytes)
+
+	dstsum, err := fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(sum, dstsum), "cksum mismatch: %s", dst)
+
+	fi, err := os.Stat(dst)
+	assert(err == nil, "stat %s: %s", dst, err)
+	assert(fi.Mode().Perm() == 0640, "perm: exp 0640, saw %s", fi.Mode().Perm())
+
+	// a regular file is copied like any other file
+	src := dst
+	fd, err := os.Open(src)
+	assert(err == nil, "open %s: %s", src, err)
+	defer fd.Close()
+
+	dst = filepath.Join(tmpdir, "file-b")
+	st, err = CopyReader(dst, fd, 0600)
+	assert(err == nil, "copy %s to %s: %s", src, dst, err)
+	assert(st.Method&COPY_RW == 0, "file: exp no read-write, saw %s", st.Method)
+
+	dstsum, err = fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(sum, dstsum), "cksum mismatch: %s", dst)
+
+	// a pipe
+	rfd, wfd, err := os.Pipe()
+	assert(err == nil, "pipe: %s", err)
+	defer rfd.Close()
+
+	go func() {
+		for b := buf; len(b) > 0; {
+			n := min(len(b), 4096)
+			wfd.Write(b[:n])
+			b = b[n:]
+		}
+		wfd.Close()
+	}()
+
+	dst = filepath.Join(tmpdir, "file-c")
+	st, err = CopyReader(dst, rfd, 0600)
+	assert(err == nil, "copy pipe to %s: %s", dst, err)
+	assert(st.Bytes == int64(len(buf)), "pipe: exp %d bytes, saw %d", len(buf), st.Bytes)
+	if runtime.GOOS == "linux" {
+		assert(st.Method == COPY_SPLICE, "pipe: exp splice, saw %s", st.Method)
+	}
+
+	dstsum, err = fileCksum(dst)
+	assert(err == nil, "cksum %s: %s", dst, err)
+	assert(byteEq(sum, dstsum), "cksum mismatch: %s", dst)
+}
+
+func TestCopyFS(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fsys := fstest.MapFS{
+		"a.txt":       {Data: []byte("hello"), Mode: 0644, ModTime: mtime},
+		"b/c.txt":     {Data: randbuf(make([]byte, 300*1024)), Mode: 0600, ModTime: mtime},
+		"b/d/e.txt":   {Data: []byte("world"), Mode: 0400, ModTime: mtime},
+		"b/d":         {Mode: fs.ModeDir | 0500, ModTime: mtime},
+		"b/empty.txt": {Mode: 0644, ModTime: mtime},
+	}
+
+	dst := filepath.Join(tmpdir, "out")
+	st, err := CopyFS(dst, fsys, WithVerify(true))
+	assert(err == nil, "copyfs: %s", err)
+	assert(st.Bytes == int64(10+300*1024), "copyfs: exp %d bytes, saw %d", 10+300*1024, st.Bytes)
+
+	for nm, f := range fsys {
+		fn := filepath.Join(dst, filepath.FromSlash(nm))
+		fi, err := os.Stat(fn)
+		assert(err == nil, "stat %s: %s", fn, err)
+		assert(fi.Mode() == f.Mode, "%s: exp mode %s, saw %s", nm, f.Mode, fi.Mode())
+		assert(fi.ModTime().Equal(mtime), "%s: exp mtime %s, saw %s", nm, mtime, fi.ModTime())
+
+		if f.Mode.IsRegular() {
+			b, err := os.ReadFile(fn)
+			assert(err == nil, "read %s: %s", fn, err)
+			assert(byteEq(b, f.Data), "%s: content mismatch", nm)
+		}
+	}
+
+	// we don't know how to copy symlinks out of a fs.FS
+	fsys["link"] = &fstest.MapFile{Data: []byte("a.txt"), Mode: fs.ModeSymlink | 0777}
+	_, err = CopyFS(filepath.Join(tmpdir, "out2"), fsys)
+	assert(errors.Is(err, errors.ErrUnsupported), "symlink: exp ErrUnsupported, saw %v", err)
+
+	// allow the test dir to be cleaned up
+	os.Chmod(filepath.Join(dst, "b", "d"), 0700)
+}
+
 var testDir = flag.String("testdir", "", "Use 'T' as the testdir for file I/O tests")
 
 func getTmpdir(t *testing.T) string {
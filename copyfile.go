@@ -15,6 +15,8 @@
 package fio
 
 import (
+	"context"
+	"errors"
 	"io/fs"
 	"os"
 )
@@ -25,7 +27,37 @@ import (
 // fallback to copying via memory mapping 'src' and writing the blocks
 // to 'dst'.
 func CopyFile(dst, src string, perm fs.FileMode) error {
-	return sysCopyFile(dst, src, perm)
+	_, err := CopyFileContext(context.Background(), dst, src, perm)
+	return err
+}
+
+// CopyFileContext is like CopyFile - except the copy can be cancelled
+// via 'ctx' and tuned via the options in 'opt'. A cancelled copy
+// doesn't leave behind any partially written 'dst'. It returns
+// the stats describing how the file was copied.
+func CopyFileContext(ctx context.Context, dst, src string, perm fs.FileMode, opt ...CopyOption) (*CopyStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CopyError{"cancel", src, dst, err}
+	}
+
+	c := newCopier(ctx, opt)
+	if c.ckpt > 0 && c.blksz > 0 {
+		return nil, &CopyError{"options", src, dst, ErrDeltaResume}
+	}
+
+	copyFile := sysCopyFile
+	switch {
+	case c.ckpt > 0:
+		copyFile = resumeCopy
+	case c.blksz > 0:
+		copyFile = deltaCopy
+	}
+
+	if err := copyFile(c, dst, src, perm); err != nil {
+		return nil, err
+	}
+
+	return c.finish(), nil
 }
 
 // CopyFd copies open files 'src' to 'dst' using the most efficient OS
@@ -34,5 +66,80 @@ func CopyFile(dst, src string, perm fs.FileMode) error {
 // It will fallback to copying via memory mapping 'src' and writing the
 // blocks to 'dst'.
 func CopyFd(dst, src *os.File) error {
-	return sysCopyFd(dst, src)
+	_, err := CopyFdOpts(context.Background(), dst, src)
+	return err
+}
+
+// CopyFdOpts is like CopyFd - except the copy can be cancelled via
+// 'ctx' and tuned via the options in 'opt'. The caller is responsible
+// for discarding 'dst' if the copy is cancelled; using a SafeFile for
+// 'dst' makes this easy. It returns the stats describing how the file
+// was copied.
+func CopyFdOpts(ctx context.Context, dst, src *os.File, opt ...CopyOption) (*CopyStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CopyError{"cancel", src.Name(), dst.Name(), err}
+	}
+
+	c := newCopier(ctx, opt)
+	if err := copyFd(c, dst, src); err != nil {
+		return nil, err
+	}
+
+	return c.finish(), nil
+}
+
+// copy src to dst using the best available primitive and verify the
+// copy if needed.
+func copyFd(c *copier, dst, src *os.File) error {
+	if !c.srccheck {
+		if err := sysCopyFd(c, dst, src); err != nil {
+			return err
+		}
+		return c.check(dst, src)
+	}
+
+	for i := 0; ; i++ {
+		before, err := Fstat(src)
+		if err != nil {
+			return &CopyError{"stat-src", src.Name(), dst.Name(), err}
+		}
+
+		// a truncated mmap'd source is just another change
+		err = sysCopyFd(c, dst, src)
+		if err != nil && !errors.Is(err, ErrSourceChanged) {
+			return err
+		}
+
+		after, serr := Fstat(src)
+		if serr != nil {
+			return &CopyError{"stat-src", src.Name(), dst.Name(), serr}
+		}
+
+		if err == nil && !srcChanged(before, after) {
+			return c.check(dst, src)
+		}
+
+		if i >= c.retries {
+			break
+		}
+
+		if err = c.restart(dst); err != nil {
+			return &CopyError{"restart", src.Name(), dst.Name(), err}
+		}
+	}
+
+	if !c.commitChanged {
+		return &CopyError{"copy", src.Name(), dst.Name(), ErrSourceChanged}
+	}
+
+	// the checksums won't match; so we don't verify
+	c.stats.Inconsistent++
+	return nil
+}
+
+// srcChanged returns true if the two snapshots of a source file
+// show that it was modified in the interim
+func srcChanged(a, b *Info) bool {
+	return a.Dev != b.Dev || a.Ino != b.Ino || a.Siz != b.Siz ||
+		!a.Mtim.Equal(b.Mtim) || !a.Ctim.Equal(b.Ctim)
 }
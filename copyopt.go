@@ -0,0 +1,532 @@
+// copyopt.go - options and state for cancellable file copies
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Do copies in chunks of _ioChunkSize
+const _ioChunkSize int = 256 * 1024
+
+// CopyOption captures the various options for copying files
+// via CopyFileContext() and CopyFdOpts().
+type CopyOption func(o *copyOpt)
+
+// WithProgress calls 'fp' with the number of bytes copied so far and
+// the total size of the source file. The callback is invoked no more
+// frequently than once every 'interval'; it is always invoked once
+// when the copy completes. 'total' is -1 if the size of the source isn't
+// known in advance (eg when copying from a pipe via CopyReader()).
+func WithProgress(interval time.Duration, fp func(done, total int64)) CopyOption {
+	return func(o *copyOpt) {
+		o.interval = interval
+		o.progress = fp
+	}
+}
+
+// WithRateLimit limits the copy throughput to 'bps' bytes/sec. A
+// value <= 0 disables rate limiting.
+func WithRateLimit(bps int64) CopyOption {
+	return func(o *copyOpt) {
+		o.rate = max(bps, 0)
+	}
+}
+
+// WithCopyMethods restricts the copy to the primitives in 'm'. This can
+// be used to forbid a method (eg "never reflink" for backups) or to
+// force one (eg COPY_REFLINK only). The copy fails with ErrNoCopyMethod
+// if none of the allowed methods are usable.
+func WithCopyMethods(m CopyMethod) CopyOption {
+	return func(o *copyOpt) {
+		o.methods = m & COPY_ALL
+	}
+}
+
+// WithVerify verifies that the copied bytes in the destination are
+// identical to the source. The source is hashed while it is read and
+// the destination is re-read after it is synced to disk. A mismatch
+// fails the copy with a CopyError whose Op is "verify".
+func WithVerify(verify bool) CopyOption {
+	return func(o *copyOpt) {
+		o.verify = verify
+	}
+}
+
+// WithParallel copies files of size 'threshold' bytes or larger by
+// splitting them into ranges that are copied concurrently by 'ncpu'
+// workers. If 'ncpu' is zero or less, all available cpus are used.
+// Parallel copies use copy_file_range(2) where available and fall back
+// to pread(2)/pwrite(2) - or to a serial copy if copy_file_range(2)
+// can't copy the file. The holes in sparse files are skipped where the
+// platform can find them.
+func WithParallel(threshold int64, ncpu int) CopyOption {
+	return func(o *copyOpt) {
+		if ncpu <= 0 {
+			ncpu = runtime.NumCPU()
+		}
+		o.threshold = max(threshold, 0)
+		o.ncpu = ncpu
+	}
+}
+
+// WithResume makes CopyFileContext() resumable: the copy is written to
+// a partial file that survives errors and cancellation, and its progress
+// is checkpointed every 'ckpt' bytes. A subsequent copy of the same src
+// to the same dst resumes from the last checkpoint if the source hasn't
+// changed; the checkpointed bytes are compared with the source and only
+// the ones that match are kept. A concurrent resumable copy to the same
+// dst fails with ErrPartialInUse. If 'ckpt' is zero or less, a default
+// interval is used. Resumable copies are done sequentially and don't
+// use reflinks; they can't be combined with WithDelta().
+func WithResume(ckpt int64) CopyOption {
+	return func(o *copyOpt) {
+		if ckpt <= 0 {
+			ckpt = _CheckpointInterval
+		}
+		o.ckpt = ckpt
+	}
+}
+
+// WithDelta updates an existing destination by rewriting only the
+// blocks of size 'blksz' that differ from the source. The new file is
+// seeded with the contents of the existing destination via a reflink
+// and committed atomically. If the destination doesn't exist or can't
+// be reflinked, the file is copied in full. Reflinks between open files
+// are only available on linux file systems that support them (eg btrfs,
+// xfs); so delta updates are linux only and other platforms (including
+// darwin) always copy in full. We don't update the destination in place
+// without a reflink because that would lose the atomic commit.
+// CopyStats.Method includes COPY_DELTA if the file was updated via a
+// delta - even if none of its blocks differed. A delta copy can't be
+// resumed: using WithDelta() with WithResume() fails the copy with
+// ErrDeltaResume.
+func WithDelta(blksz int) CopyOption {
+	return func(o *copyOpt) {
+		o.blksz = max(blksz, 0)
+	}
+}
+
+// CacheMode describes how a copy interacts with the OS page cache
+type CacheMode int
+
+const (
+	// CACHE_DEFAULT leaves the page cache management to the OS
+	CACHE_DEFAULT CacheMode = iota
+
+	// CACHE_DROP evicts the copied ranges of the source and
+	// destination from the page cache after each chunk is copied.
+	CACHE_DROP
+
+	// CACHE_DIRECT bypasses the page cache via O_DIRECT I/O where
+	// it is supported and behaves like CACHE_DROP elsewhere.
+	CACHE_DIRECT
+)
+
+// String returns a string representation of the cache mode
+func (m CacheMode) String() string {
+	switch m {
+	case CACHE_DEFAULT:
+		return "default"
+	case CACHE_DROP:
+		return "drop"
+	case CACHE_DIRECT:
+		return "direct"
+	default:
+		return fmt.Sprintf("CacheMode(%d)", int(m))
+	}
+}
+
+// WithCacheMode controls the page cache footprint of a copy. Large
+// copies (eg backups) can use CACHE_DROP or CACHE_DIRECT to avoid
+// evicting the working set of other processes from the page cache.
+// Copies that bypass the page cache don't use mmap(2) unless it is the
+// only permitted copy method. Reflinks don't copy any data and are
+// unaffected by the cache mode.
+func WithCacheMode(m CacheMode) CopyOption {
+	return func(o *copyOpt) {
+		o.cache = m
+	}
+}
+
+// WithPrealloc allocates the space for the destination before any data
+// is copied. This reduces fragmentation of large files and makes the copy
+// fail with ENOSPC up front rather than part way through. Only the data
+// regions of a sparse source are allocated; so its holes are preserved.
+// Preallocation is a no-op on platforms and file systems that don't
+// support it.
+func WithPrealloc(prealloc bool) CopyOption {
+	return func(o *copyOpt) {
+		o.prealloc = prealloc
+	}
+}
+
+// WithSourceCheck compares the size, mtime and ctime of the source
+// before and after the copy. If the source changed while it was being
+// copied, the copy is restarted up to 'retries' times. If the source
+// keeps changing, the copy fails with ErrSourceChanged - unless 'commit'
+// is true; in which case the last copy is committed and counted in
+// CopyStats.Inconsistent. Delta and resumable copies aren't checked.
+func WithSourceCheck(retries int, commit bool) CopyOption {
+	return func(o *copyOpt) {
+		o.srccheck = true
+		o.retries = max(retries, 0)
+		o.commitChanged = commit
+	}
+}
+
+type copyOpt struct {
+	// allowed copy methods
+	methods CopyMethod
+
+	// verify dst against src
+	verify bool
+
+	// progress reporting interval and callback
+	interval time.Duration
+	progress func(done, total int64)
+
+	// bytes/sec; 0 implies no limit
+	rate int64
+
+	// parallel copy of large files; only enabled if ncpu > 1
+	threshold int64
+	ncpu      int
+
+	// checkpoint interval for resumable copies; 0 disables it
+	ckpt int64
+
+	// block size for delta copies; 0 disables it
+	blksz int
+
+	// page cache usage
+	cache CacheMode
+
+	// allocate the dst before copying
+	prealloc bool
+
+	// detect changes to the source during the copy
+	srccheck      bool
+	retries       int
+	commitChanged bool
+}
+
+// copier tracks the state of a single copy operation. Parallel
+// copies update the copier concurrently; so updates to the stats and
+// progress are serialized.
+type copier struct {
+	copyOpt
+
+	ctx context.Context
+
+	mu sync.Mutex
+
+	stats CopyStats
+
+	// running checksum of src; only valid if hashed is true.
+	// It is nil if we're not verifying or copying in parallel.
+	sum    hash.Hash
+	hashed bool
+
+	total int64
+	done  int64
+
+	// bytes in 'done' that weren't copied (eg holes or the bytes of
+	// a resumed copy); they aren't subject to the rate limit.
+	unmetered int64
+
+	start time.Time
+	last  time.Time
+}
+
+func newCopier(ctx context.Context, opt []CopyOption) *copier {
+	c := &copier{
+		copyOpt: copyOpt{
+			methods: COPY_ALL,
+		},
+		ctx: ctx,
+	}
+
+	for _, fp := range opt {
+		fp(&c.copyOpt)
+	}
+
+	if c.progress == nil {
+		c.progress = func(_, _ int64) {}
+	}
+
+	if c.verify {
+		c.sum = sha256.New()
+	}
+
+	now := time.Now()
+	c.start = now
+	c.last = now
+	return c
+}
+
+// restart prepares dst and the copier for another attempt at
+// copying a source that changed.
+func (c *copier) restart(dst *os.File) error {
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// the stats of the failed attempt would stop the next one from
+	// falling back to another copy method
+	c.rewind()
+
+	c.mu.Lock()
+	c.stats.Retries++
+	c.mu.Unlock()
+
+	// parallel copies discard the checksum
+	if c.verify {
+		c.sum = sha256.New()
+	}
+	c.hashed = false
+	return nil
+}
+
+// rewind discards the progress and stats of an attempt at copying
+// the data so that the copy can start afresh.
+func (c *copier) rewind() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done = 0
+	c.unmetered = 0
+	c.stats.Method = 0
+	c.stats.Bytes = 0
+	c.stats.Reflinked = 0
+	c.stats.Holes = 0
+}
+
+// begin records the total bytes that will be copied
+func (c *copier) begin(total int64) {
+	c.total = total
+}
+
+// allow returns true if the copy method 'm' is permitted
+func (c *copier) allow(m CopyMethod) bool {
+	return c.methods&m > 0
+}
+
+// parallel returns true if a file of size 'sz' must be copied
+// in parallel
+func (c *copier) parallel(sz int64) bool {
+	if c.ncpu <= 1 || sz < c.threshold {
+		return false
+	}
+	return c.allow(COPY_RW) || (_haveCopyRange && c.allow(COPY_RANGE))
+}
+
+// mmap returns true if src can be copied via mmap(2). Mapped pages
+// can't be evicted from the page cache; so we prefer read(2) when
+// we're asked to keep the page cache clean.
+func (c *copier) mmap() bool {
+	if !c.allow(COPY_MMAP) {
+		return false
+	}
+	return c.cache == CACHE_DEFAULT || !c.allow(COPY_RW)
+}
+
+// drop evicts the range [off, off+n) of dst and src from the page
+// cache if the cache mode asks for it; src may be nil. We're only
+// giving the OS a hint; so errors are ignored.
+func (c *copier) drop(dst, src *os.File, off, n int64) {
+	if c.cache == CACHE_DEFAULT {
+		return
+	}
+
+	sysDropCache(dst, off, n, true)
+	if src != nil {
+		sysDropCache(src, off, n, false)
+	}
+}
+
+// preallocate allocates space in dst for the first 'sz' bytes of src
+// if we're asked to do so.
+func (c *copier) preallocate(dst, src *os.File, sz int64) error {
+	if !c.prealloc {
+		return nil
+	}
+
+	err := sysPrealloc(dst, src, sz)
+	if err != nil && !errAny(err, errNoPrealloc...) {
+		return &CopyError{"fallocate", src.Name(), dst.Name(), err}
+	}
+	return nil
+}
+
+// used records that method 'm' copied 'n' bytes
+func (c *copier) used(m CopyMethod, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Method |= m
+	switch m {
+	case COPY_REFLINK:
+		c.stats.Reflinked += n
+	default:
+		c.stats.Bytes += n
+	}
+}
+
+// update accounts for 'n' more bytes copied; it reports progress,
+// throttles the copy to the configured rate and returns a non-nil
+// error if the copy was cancelled.
+func (c *copier) update(n int64) error {
+	c.mu.Lock()
+	c.done += n
+
+	now := time.Now()
+	c.report(now)
+
+	// time we ought to have taken to copy what we've done so far;
+	// we sleep without the lock so that parallel copies aren't
+	// serialized.
+	var wait time.Duration
+	if c.rate > 0 {
+		want := time.Duration(float64(c.done-c.unmetered) / float64(c.rate) * float64(time.Second))
+		wait = want - now.Sub(c.start)
+	}
+	c.mu.Unlock()
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-c.ctx.Done():
+			t.Stop()
+		case <-t.C:
+		}
+	}
+
+	return c.ctx.Err()
+}
+
+// hole accounts for a hole of 'n' bytes in a sparse source that was
+// skipped; it returns a non-nil error if the copy was cancelled.
+func (c *copier) hole(n int64) error {
+	c.mu.Lock()
+	c.stats.Holes += n
+	c.mu.Unlock()
+
+	return c.skip(n)
+}
+
+// skip accounts for 'n' bytes that are already in the destination;
+// they count towards the progress but not the rate limit. It returns
+// a non-nil error if the copy was cancelled.
+func (c *copier) skip(n int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done += n
+	c.unmetered += n
+	c.report(time.Now())
+	return c.ctx.Err()
+}
+
+// report the progress if the interval has elapsed; the caller must
+// hold the lock.
+func (c *copier) report(now time.Time) {
+	if now.Sub(c.last) >= c.interval {
+		c.progress(c.done, c.total)
+		c.last = now
+	}
+}
+
+// hash accumulates the source bytes in 'b' into the running checksum
+func (c *copier) hash(b []byte) {
+	if c.sum != nil {
+		c.sum.Write(b)
+	}
+}
+
+// check verifies that dst is identical to src by comparing their
+// checksums. The source is re-read only if its checksum wasn't
+// computed during the copy.
+func (c *copier) check(dst, src *os.File) error {
+	if !c.verify {
+		return nil
+	}
+
+	if c.hashed {
+		return checkSum(dst, src.Name(), c.sum.Sum(nil))
+	}
+
+	want, err := fileHash(src)
+	if err != nil {
+		return &CopyError{"verify", src.Name(), dst.Name(), err}
+	}
+	return checkSum(dst, src.Name(), want)
+}
+
+// checkSum verifies that the checksum of dst matches 'want'; 'snm'
+// names the source in the errors we return.
+func checkSum(dst *os.File, snm string, want []byte) error {
+	if err := dst.Sync(); err != nil {
+		return &CopyError{"dst-sync", snm, dst.Name(), err}
+	}
+
+	// dst may have been opened write-only; so we open it afresh
+	fd, err := os.Open(dst.Name())
+	if err != nil {
+		return &CopyError{"verify", snm, dst.Name(), err}
+	}
+	defer fd.Close()
+
+	have, err := fileHash(fd)
+	if err != nil {
+		return &CopyError{"verify", snm, dst.Name(), err}
+	}
+
+	if subtle.ConstantTimeCompare(want, have) != 1 {
+		return &CopyError{"verify", snm, dst.Name(), ErrVerify}
+	}
+	return nil
+}
+
+// fileHash returns the sha256 checksum of the contents of fd
+func fileHash(fd *os.File) ([]byte, error) {
+	h := sha256.New()
+	_, err := mmapReader(fd, func(b []byte) error {
+		h.Write(b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// finish reports the final progress and returns the copy stats
+func (c *copier) finish() *CopyStats {
+	c.progress(c.done, c.total)
+	c.stats.Elapsed = time.Since(c.start)
+	return &c.stats
+}
@@ -0,0 +1,104 @@
+// copystats.go - statistics describing a completed file copy
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CopyMethod identifies the OS primitive used to copy a file. The
+// methods can be bitwise OR'd to describe a set of methods.
+type CopyMethod uint
+
+const (
+	COPY_REFLINK CopyMethod = 1 << iota // copy-on-write clone (reflink, clonefile)
+	COPY_RANGE                          // in-kernel copy via copy_file_range(2)
+	COPY_MMAP                           // mmap(2) the source and write(2) the dst
+	COPY_RW                             // read(2) the source and write(2) the dst
+	COPY_DELTA                          // rewrite only the changed blocks of the dst
+	COPY_SPLICE                         // in-kernel copy from a pipe via splice(2)
+
+	// This is a short cut for "use any available method"
+	COPY_ALL = COPY_REFLINK | COPY_RANGE | COPY_MMAP | COPY_RW | COPY_DELTA | COPY_SPLICE
+)
+
+var copyMethodName = []struct {
+	m    CopyMethod
+	name string
+}{
+	{COPY_REFLINK, "reflink"},
+	{COPY_RANGE, "copy-range"},
+	{COPY_MMAP, "mmap"},
+	{COPY_RW, "read-write"},
+	{COPY_DELTA, "delta"},
+	{COPY_SPLICE, "splice"},
+}
+
+// String returns a string representation of the copy methods
+func (m CopyMethod) String() string {
+	var z []string
+	for i := range copyMethodName {
+		x := &copyMethodName[i]
+		if m&x.m > 0 {
+			z = append(z, x.name)
+		}
+	}
+	return strings.Join(z, "|")
+}
+
+// CopyStats describes the work done by a file copy. When stats of
+// multiple copies are aggregated (via Add), Method is the set of
+// all the methods used.
+type CopyStats struct {
+	// Method used to copy the file
+	Method CopyMethod
+
+	// Bytes transferred to the destination
+	Bytes int64
+
+	// Bytes shared with the source via copy-on-write
+	Reflinked int64
+
+	// Bytes of holes in a sparse source that were skipped
+	Holes int64
+
+	// Number of times a copy was restarted because its source
+	// changed; see WithSourceCheck()
+	Retries int64
+
+	// Number of files whose source kept changing during the copy
+	Inconsistent int64
+
+	// Total time taken for the copy
+	Elapsed time.Duration
+}
+
+// Add accumulates the stats in 'b' into 's'
+func (s *CopyStats) Add(b *CopyStats) {
+	s.Method |= b.Method
+	s.Bytes += b.Bytes
+	s.Reflinked += b.Reflinked
+	s.Holes += b.Holes
+	s.Retries += b.Retries
+	s.Inconsistent += b.Inconsistent
+	s.Elapsed += b.Elapsed
+}
+
+// String returns a string representation of CopyStats
+func (s *CopyStats) String() string {
+	return fmt.Sprintf("%s: %d bytes, %d reflinked, %d holes, %d retries, %d inconsistent; %s",
+		s.Method, s.Bytes, s.Reflinked, s.Holes, s.Retries, s.Inconsistent, s.Elapsed)
+}
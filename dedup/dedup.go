@@ -0,0 +1,300 @@
+// dedup.go - deduplicate identical files in dir trees
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package dedup finds byte-identical files in one or more directory
+// trees and makes them share their storage extents via fio.Dedupe().
+// Candidate files are grouped by their size and then by the sha256
+// digest of their contents; the kernel verifies that the files are
+// identical before their extents are shared.
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/opencoff/go-fio"
+	"github.com/opencoff/go-fio/walk"
+)
+
+type Option func(o *dedupOpt)
+
+// WithWalkOptions uses 'wo' as the option for walk.Walk(); only
+// regular files are considered for deduplication.
+func WithWalkOptions(wo walk.Options) Option {
+	return func(o *dedupOpt) {
+		o.Options = wo
+	}
+}
+
+// WithDryRun finds the identical files and reports the bytes that can
+// be reclaimed without deduplicating any of them.
+func WithDryRun(dry bool) Option {
+	return func(o *dedupOpt) {
+		o.dryRun = dry
+	}
+}
+
+// WithMinSize ignores files smaller than 'sz' bytes. Empty files
+// are always ignored.
+func WithMinSize(sz int64) Option {
+	return func(o *dedupOpt) {
+		o.minSize = max(sz, 1)
+	}
+}
+
+type dedupOpt struct {
+	walk.Options
+
+	dryRun  bool
+	minSize int64
+}
+
+func defaultOptions() dedupOpt {
+	opt := dedupOpt{
+		Options: walk.Options{
+			Concurrency: runtime.NumCPU(),
+		},
+		minSize: 1,
+	}
+	return opt
+}
+
+// Report describes the identical files found by Tree()
+type Report struct {
+	// Sets of identical files; the rest of the files in a set are
+	// deduplicated against the first.
+	Groups [][]string
+
+	// Bytes that can be reclaimed by deduplicating the files in
+	// Groups. This is an upper bound: files that already share
+	// their extents are counted as well.
+	Reclaimable int64
+
+	// Bytes that were deduplicated; this is zero for a dry-run.
+	Deduped int64
+}
+
+// String returns a string representation of the report
+func (r *Report) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d groups, %d bytes reclaimable, %d bytes deduped\n",
+		len(r.Groups), r.Reclaimable, r.Deduped)
+	for _, g := range r.Groups {
+		fmt.Fprintf(&b, "\t%s\n", strings.Join(g, " "))
+	}
+	return b.String()
+}
+
+// Tree finds the identical regular files in the trees 'names' and
+// deduplicates them. Files on different file systems are never
+// deduplicated against each other. Files that change after they are
+// hashed are skipped. Tree returns the report even if some of the
+// files couldn't be deduplicated.
+func Tree(names []string, opt ...Option) (*Report, error) {
+	option := defaultOptions()
+	for _, fp := range opt {
+		fp(&option)
+	}
+
+	wo := option.Options
+	wo.Type = walk.FILE
+
+	// hardlinks already share their storage
+	wo.IgnoreDuplicateInode = true
+
+	// group the candidate files by their size
+	var mu sync.Mutex
+	bySize := make(map[sizeKey][]string)
+
+	err := walk.WalkFunc(names, wo, func(fi *fio.Info) error {
+		if fi.Size() < option.minSize {
+			return nil
+		}
+
+		k := sizeKey{fi.Dev, fi.Size()}
+		mu.Lock()
+		bySize[k] = append(bySize[k], fi.Path())
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := hashGroups(bySize, option.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{}
+	for _, g := range groups {
+		r.Groups = append(r.Groups, g.names)
+		r.Reclaimable += g.size * int64(len(g.names)-1)
+	}
+
+	if option.dryRun {
+		return r, nil
+	}
+
+	err = dedupe(r, groups, option.Concurrency)
+	return r, err
+}
+
+// files on the same file system with the same size
+type sizeKey struct {
+	dev  uint64
+	size int64
+}
+
+// files on the same file system with identical contents
+type digestKey struct {
+	dev  uint64
+	size int64
+	sum  [sha256.Size]byte
+}
+
+// a set of identical files
+type group struct {
+	size  int64
+	names []string
+}
+
+// hash the files that share their size with other files and return
+// the sets of identical files.
+func hashGroups(bySize map[sizeKey][]string, ncpu int) ([]group, error) {
+	type hashWork struct {
+		sizeKey
+		nm string
+	}
+
+	// files that vanish have a zero key
+	type hashed struct {
+		digestKey
+		nm string
+	}
+
+	work := func(yield func(hashWork) bool) {
+		for k, names := range bySize {
+			if len(names) < 2 {
+				continue
+			}
+			for _, nm := range names {
+				if !yield(hashWork{k, nm}) {
+					return
+				}
+			}
+		}
+	}
+
+	hash := func(_ context.Context, w hashWork) (hashed, error) {
+		sum, err := fileHash(w.nm)
+		if err != nil {
+			// a file that vanished can't be deduplicated
+			if errors.Is(err, os.ErrNotExist) {
+				return hashed{}, nil
+			}
+			return hashed{}, err
+		}
+		return hashed{digestKey{w.dev, w.size, sum}, w.nm}, nil
+	}
+
+	collect := func(m map[digestKey][]string, h hashed) map[digestKey][]string {
+		if len(h.nm) > 0 {
+			m[h.digestKey] = append(m[h.digestKey], h.nm)
+		}
+		return m
+	}
+
+	byDigest, err := fio.Reduce(context.Background(), ncpu, work, hash,
+		make(map[digestKey][]string), collect)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []group
+	for k, names := range byDigest {
+		if len(names) < 2 {
+			continue
+		}
+
+		slices.Sort(names)
+		groups = append(groups, group{k.size, names})
+	}
+
+	slices.SortFunc(groups, func(a, b group) int {
+		return strings.Compare(a.names[0], b.names[0])
+	})
+	return groups, nil
+}
+
+// dedupe the files in each group against the first file of the group
+func dedupe(r *Report, groups []group, ncpu int) error {
+	type dedupeWork struct {
+		dst, src string
+	}
+
+	var deduped atomic.Int64
+	wp := fio.NewWorkPool[dedupeWork](ncpu, func(_ int, w dedupeWork) error {
+		n, err := fio.Dedupe(w.dst, w.src)
+		deduped.Add(n)
+
+		// the file changed after we hashed it
+		if errors.Is(err, fio.ErrDedupeDiffers) {
+			return nil
+		}
+		return err
+	})
+
+	go func() {
+		for _, g := range groups {
+			for _, nm := range g.names[1:] {
+				wp.Submit(dedupeWork{nm, g.names[0]})
+			}
+		}
+		wp.Close()
+	}()
+
+	err := wp.Wait()
+	r.Deduped = deduped.Load()
+	return err
+}
+
+// fileHash returns the sha256 digest of the contents of file 'nm'
+func fileHash(nm string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	fd, err := os.Open(nm)
+	if err != nil {
+		return sum, err
+	}
+
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, fd); err != nil {
+		return sum, fmt.Errorf("hash %s: %w", nm, err)
+	}
+
+	h.Sum(sum[:0])
+	return sum, nil
+}
@@ -0,0 +1,104 @@
+// dedup_test.go - tests for tree deduplication
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package dedup
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestDedupDryRun(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	a, b := mktree(t, tmp)
+
+	r, err := Tree([]string{filepath.Join(tmp, "lhs"), filepath.Join(tmp, "rhs")}, WithDryRun(true))
+	assert(err == nil, "dedup: %s", err)
+	assert(r.Deduped == 0, "dry-run: exp 0 deduped, saw %d", r.Deduped)
+	assert(len(r.Groups) == 2, "exp 2 groups, saw %s", r)
+	assert(slices.Equal(r.Groups[0], a), "exp %v, saw %v", a, r.Groups[0])
+	assert(slices.Equal(r.Groups[1], b), "exp %v, saw %v", b, r.Groups[1])
+	assert(r.Reclaimable == 2*4096+8192, "exp %d reclaimable, saw %d", 2*4096+8192, r.Reclaimable)
+
+	// small files are ignored
+	r, err = Tree([]string{tmp}, WithDryRun(true), WithMinSize(5000))
+	assert(err == nil, "dedup: %s", err)
+	assert(len(r.Groups) == 1, "exp 1 group, saw %s", r)
+	assert(slices.Equal(r.Groups[0], b), "exp %v, saw %v", b, r.Groups[0])
+}
+
+func TestDedup(t *testing.T) {
+	assert := newAsserter(t)
+	tmp := getTmpdir(t)
+
+	mktree(t, tmp)
+
+	r, err := Tree([]string{tmp})
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EINVAL) {
+		t.Skipf("dedupe not supported on %s: %s", tmp, err)
+	}
+	assert(err == nil, "dedup: %s", err)
+	assert(r.Deduped == r.Reclaimable, "exp %d deduped, saw %s", r.Reclaimable, r)
+}
+
+// make a tree with two sets of identical files and return them
+func mktree(t *testing.T, tmp string) ([]string, []string) {
+	assert := newAsserter(t)
+
+	small := make([]byte, 4096)
+	big := make([]byte, 8192)
+	uniq := make([]byte, 8192)
+	rand.Read(small)
+	rand.Read(big)
+	rand.Read(uniq)
+
+	files := map[string][]byte{
+		"lhs/a/1":   small,
+		"lhs/b/2":   small,
+		"rhs/a/3":   small,
+		"lhs/big":   big,
+		"rhs/c/big": big,
+		"rhs/uniq":  uniq,
+		"rhs/empty": nil,
+		"lhs/empty": nil,
+	}
+
+	for nm, b := range files {
+		fn := filepath.Join(tmp, nm)
+		err := os.MkdirAll(filepath.Dir(fn), 0700)
+		assert(err == nil, "mkdir %s: %s", fn, err)
+		err = os.WriteFile(fn, b, 0600)
+		assert(err == nil, "write %s: %s", fn, err)
+	}
+
+	// hardlinks already share their storage
+	err := os.Link(filepath.Join(tmp, "rhs/uniq"), filepath.Join(tmp, "lhs/uniq"))
+	assert(err == nil, "link: %s", err)
+
+	a := []string{"lhs/a/1", "lhs/b/2", "rhs/a/3"}
+	b := []string{"lhs/big", "rhs/c/big"}
+	for i := range a {
+		a[i] = filepath.Join(tmp, a[i])
+	}
+	for i := range b {
+		b[i] = filepath.Join(tmp, b[i])
+	}
+	return a, b
+}
@@ -0,0 +1,61 @@
+// dedupe.go - share the extents of identical files
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"os"
+)
+
+// Dedupe makes the byte-identical files 'dst' and 'src' share their
+// storage extents on file systems that support it (eg btrfs, xfs). The
+// kernel compares the contents of the two files before sharing any
+// extents; so files that differ are left untouched and ErrDedupeDiffers
+// is returned. Unlike a reflink, 'dst' retains its identity (inode,
+// metadata). Dedupe returns the number of bytes that were deduplicated.
+func Dedupe(dst, src string) (int64, error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return 0, &CopyError{"open-src", src, dst, err}
+	}
+
+	defer s.Close()
+
+	// the kernel wants dst to be writable unless we own it
+	d, err := os.OpenFile(dst, os.O_RDWR, 0)
+	if err != nil {
+		return 0, &CopyError{"open-dst", src, dst, err}
+	}
+
+	defer d.Close()
+
+	si, err := Fstat(s)
+	if err != nil {
+		return 0, &CopyError{"stat-src", src, dst, err}
+	}
+
+	di, err := Fstat(d)
+	if err != nil {
+		return 0, &CopyError{"stat-dst", src, dst, err}
+	}
+
+	if !si.IsRegular() || !di.IsRegular() || si.Size() != di.Size() {
+		return 0, &CopyError{"dedupe", src, dst, ErrDedupeDiffers}
+	}
+
+	n, err := sysDedupe(d, s, si.Size())
+	if err != nil {
+		return n, &CopyError{"dedupe", src, dst, err}
+	}
+	return n, nil
+}
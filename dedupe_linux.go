@@ -0,0 +1,60 @@
+// dedupe_linux.go - share the extents of identical files on linux
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package fio
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Some file systems limit the size of a single dedupe request
+const _maxDedupeSize int64 = 16 * 1024 * 1024
+
+// dedupe the first 'sz' bytes of dst and src via FIDEDUPERANGE
+func sysDedupe(dst, src *os.File, sz int64) (int64, error) {
+	s := int(src.Fd())
+	d := int64(dst.Fd())
+
+	var done int64
+	for done < sz {
+		r := unix.FileDedupeRange{
+			Src_offset: uint64(done),
+			Src_length: uint64(min(sz-done, _maxDedupeSize)),
+			Info: []unix.FileDedupeRangeInfo{
+				{Dest_fd: d, Dest_offset: uint64(done)},
+			},
+		}
+
+		if err := unix.IoctlFileDedupeRange(s, &r); err != nil {
+			return done, err
+		}
+
+		info := &r.Info[0]
+		switch {
+		case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return done, ErrDedupeDiffers
+		case info.Status < 0:
+			return done, syscall.Errno(-info.Status)
+		case info.Bytes_deduped == 0:
+			return done, fmt.Errorf("zero sized dedupe at off %d", done)
+		}
+		done += int64(info.Bytes_deduped)
+	}
+	return done, nil
+}
@@ -0,0 +1,26 @@
+// dedupe_other.go - extent sharing for non-linux platforms
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// FIDEDUPERANGE is linux specific
+func sysDedupe(dst, src *os.File, sz int64) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
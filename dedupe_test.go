@@ -0,0 +1,54 @@
+// dedupe_test.go - extent sharing tests
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDedupe(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	a := filepath.Join(tmpdir, "file-a")
+	b := filepath.Join(tmpdir, "file-b")
+	c := filepath.Join(tmpdir, "file-c")
+
+	buf := randbuf(make([]byte, 1024*1024))
+	err := os.WriteFile(a, buf, 0600)
+	assert(err == nil, "write %s: %s", a, err)
+	err = os.WriteFile(b, buf, 0600)
+	assert(err == nil, "write %s: %s", b, err)
+	_, err = createFile(c, 1024*1024)
+	assert(err == nil, "create %s: %s", c, err)
+
+	n, err := Dedupe(b, a)
+	if errAny(err, syscall.ENOTSUP, syscall.EINVAL, syscall.EXDEV) {
+		t.Skipf("dedupe not supported on %s: %s", tmpdir, err)
+	}
+	assert(err == nil, "dedupe %s %s: %s", b, a, err)
+	assert(n == int64(len(buf)), "dedupe: exp %d bytes, saw %d", len(buf), n)
+
+	// the kernel must refuse to dedupe files that differ
+	_, err = Dedupe(c, a)
+	assert(errors.Is(err, ErrDedupeDiffers), "dedupe: exp ErrDedupeDiffers, saw %v", err)
+
+	sum, err := fileCksum(b)
+	assert(err == nil, "cksum %s: %s", b, err)
+	assert(byteEq(sum, cksum(buf)), "cksum mismatch: %s", b)
+}
@@ -16,6 +16,7 @@ package fio
 import (
 	"errors"
 	"fmt"
+	"syscall"
 )
 
 // errAny returns true if the target error 'err' matches
@@ -50,3 +51,39 @@ func (e *CopyError) Unwrap() error {
 }
 
 var _ error = &CopyError{}
+
+// errors denoting that reflinks aren't supported for a pair of files
+var errNoReflink = []error{syscall.ENOTSUP, syscall.ENOSYS, syscall.EXDEV}
+
+// errors denoting that a file system can't preallocate space
+var errNoPrealloc = []error{syscall.ENOTSUP, syscall.ENOSYS, syscall.EOPNOTSUPP}
+
+// errors denoting that copy_file_range(2) can't copy between two files
+var errNoCopyRange = []error{syscall.ENOTSUP, syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL}
+
+// errors denoting that a pipe can't be spliced into a file
+var errNoSplice = []error{syscall.EINVAL, syscall.ENOTSUP, syscall.ENOSYS}
+
+// ErrNoCopyMethod is returned when none of the copy methods
+// permitted by WithCopyMethods() can copy a file.
+var ErrNoCopyMethod = errors.New("copyfile: no usable copy method")
+
+// ErrSourceChanged is returned when the source file is modified
+// (eg truncated) while it is being copied.
+var ErrSourceChanged = errors.New("copyfile: source changed during copy")
+
+// ErrDedupeDiffers is returned when the files given to Dedupe()
+// aren't byte-identical.
+var ErrDedupeDiffers = errors.New("dedupe: file contents differ")
+
+// ErrPartialInUse is returned when the partial file of a resumable
+// SafeFile (and hence a resumable copy) is in use by another writer.
+var ErrPartialInUse = errors.New("safefile: partial file in use")
+
+// ErrDeltaResume is returned when a copy asks for both a delta update
+// and a resumable copy.
+var ErrDeltaResume = errors.New("copyfile: delta copies can't be resumed")
+
+// ErrVerify is returned when a verified copy finds that the
+// destination contents don't match the source.
+var ErrVerify = errors.New("copyfile: checksum mismatch")
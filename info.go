@@ -20,6 +20,8 @@ import (
 	"path/filepath"
 	"syscall"
 	"time"
+
+	"github.com/opencoff/go-fio/internal/walkinfo"
 )
 
 // Info represents a file/dir metadata in a normalized form
@@ -44,6 +46,11 @@ type Info struct {
 
 	path  string
 	Xattr Xattr
+
+	// set by walk: the path relative to the root of the walk
+	// and the depth below the root.
+	rel   string
+	depth int
 }
 
 const (
@@ -165,6 +172,32 @@ func (ii *Info) SetPath(p string) {
 	ii.path = p
 }
 
+// RelPath returns the path of this entry relative to the root of the
+// walk that returned it; the root itself is ".". It is empty for
+// entries that weren't returned by a walk.
+func (ii *Info) RelPath() string {
+	return ii.rel
+}
+
+// Depth returns the depth of this entry below the root of the walk
+// that returned it; the root is at depth 0.
+func (ii *Info) Depth() int {
+	return ii.depth
+}
+
+// setRelPath sets the root-relative path and depth of this entry
+func (ii *Info) setRelPath(rel string, depth int) {
+	ii.rel = rel
+	ii.depth = depth
+}
+
+// the walk package sets the root-relative path via walkinfo
+func init() {
+	walkinfo.SetRelPath = func(fi any, rel string, depth int) {
+		fi.(*Info).setRelPath(rel, depth)
+	}
+}
+
 // fs.FileInfo methods of Info
 
 // Name satisfies fs.FileInfo and returns the basename of the fs entry.
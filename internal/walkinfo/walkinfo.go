@@ -0,0 +1,20 @@
+// walkinfo.go - walk specific state of fio.Info
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package walkinfo lets the walk package set the root-relative path
+// and depth of a fio.Info without exporting a mutator on it.
+package walkinfo
+
+// SetRelPath sets the root-relative path and depth of 'fi' - a
+// *fio.Info. It is installed by package fio when it is initialized.
+var SetRelPath func(fi any, rel string, depth int)
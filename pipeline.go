@@ -0,0 +1,187 @@
+// pipeline.go - concurrent map and reduce on top of WorkPool
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"runtime/debug"
+	"slices"
+)
+
+// WithOrdered makes Pipeline() return its results in the order of its
+// inputs. Results that complete early are buffered until the results
+// of all the preceding inputs are returned; at most a few results per
+// worker are buffered and a slow input holds back the inputs after
+// them. It has no effect on a WorkPool.
+func WithOrdered(ordered bool) WorkPoolOption {
+	return func(o *workPoolOpt) {
+		o.ordered = ordered
+	}
+}
+
+// Pipeline concurrently applies 'fp' to each input in 'in' using 'nworkers'
+// workers and returns an iterator over the results. Each result is
+// paired with the error returned by 'fp' for that input. In fail-fast
+// mode (WithFailFast), the iteration ends after the first error.
+// Results are returned in the order they complete unless WithOrdered()
+// is used. Breaking out of the iteration cancels the outstanding work
+// and waits for the workers to finish; so 'fp' is never running after
+// the iteration ends. If 'ctx' is cancelled, the iteration ends with
+// the context's error. The other options (eg WithWorkPoolHook(),
+// WithAdaptive()) apply to the pool of workers that runs 'fp'.
+func Pipeline[In, Out any](ctx context.Context, nworkers int, in iter.Seq[In], fp func(ctx context.Context, v In) (Out, error), opt ...WorkPoolOption) iter.Seq2[Out, error] {
+	var o workPoolOpt
+	for _, fn := range opt {
+		fn(&o)
+	}
+
+	type item struct {
+		seq uint64
+		v   In
+	}
+
+	type result struct {
+		seq uint64
+		out Out
+		err error
+	}
+
+	// results of an ordered pipeline that can be outstanding
+	window := 4 * o.poolSize(nworkers)
+
+	// the pool gets the caller's options; WithOrdered() only applies
+	// to the pipeline.
+	popt := append(slices.Clip(opt), WithOrdered(false))
+
+	return func(yield func(Out, error) bool) {
+		out := make(chan result, max(nworkers, 1))
+
+		// we cancel the pool when the caller stops iterating and
+		// wait for the feeder to close 'out' after the workers are done.
+		mctx, cancel := context.WithCancel(ctx)
+		defer func() {
+			cancel()
+			for range out {
+			}
+		}()
+
+		// an ordered pipeline can't start an input until there's
+		// room to buffer its result.
+		var slots chan struct{}
+		if o.ordered {
+			slots = make(chan struct{}, window)
+		}
+
+		wp := NewWorkPoolContext[item](mctx, nworkers, func(ctx context.Context, _ int, w item) error {
+			v, err := pcall(ctx, fp, w.v)
+			select {
+			case out <- result{w.seq, v, err}:
+			case <-ctx.Done():
+			}
+
+			// errors are delivered with the results
+			return nil
+		}, popt...)
+
+		go func() {
+			defer close(out)
+
+			var seq uint64
+			for v := range in {
+				if slots != nil {
+					select {
+					case slots <- struct{}{}:
+					case <-mctx.Done():
+					}
+				}
+
+				if wp.Submit(item{seq, v}) != nil {
+					break
+				}
+				seq++
+			}
+			wp.Close()
+			wp.Wait()
+		}()
+
+		var zero Out
+		emit := func(r result) bool {
+			if !yield(r.out, r.err) {
+				return false
+			}
+			return r.err == nil || !o.failFast
+		}
+
+		var next uint64
+		pending := make(map[uint64]result)
+		for r := range out {
+			if !o.ordered {
+				if !emit(r) {
+					return
+				}
+				continue
+			}
+
+			pending[r.seq] = r
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+
+				delete(pending, next)
+				<-slots
+				next++
+				if !emit(r) {
+					return
+				}
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			yield(zero, err)
+		}
+	}
+}
+
+// Reduce concurrently applies 'fp' to each input in 'in' via Pipeline()
+// and folds the results into 'acc' via 'reduce'. The reduce function is
+// called sequentially from the caller's goroutine; so it doesn't need
+// any locking. Failed inputs aren't reduced; their errors are returned
+// along with the accumulated value.
+func Reduce[In, Out, Acc any](ctx context.Context, nworkers int, in iter.Seq[In], fp func(ctx context.Context, v In) (Out, error), acc Acc, reduce func(acc Acc, v Out) Acc, opt ...WorkPoolOption) (Acc, error) {
+	var errs []error
+	for v, err := range Pipeline(ctx, nworkers, in, fp, opt...) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		acc = reduce(acc, v)
+	}
+	return acc, errors.Join(errs...)
+}
+
+// call 'fp' and convert its panic into a PanicError; the pool can't
+// return it with the result of 'v'.
+func pcall[In, Out any](ctx context.Context, fp func(ctx context.Context, v In) (Out, error), v In) (out Out, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = &PanicError{e, debug.Stack()}
+		}
+	}()
+
+	return fp(ctx, v)
+}
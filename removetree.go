@@ -0,0 +1,313 @@
+// removetree.go - concurrent removal of dir trees
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// RemoveOption captures the options for RemoveTree()
+type RemoveOption func(o *removeOpt)
+
+// WithOneFS makes RemoveTree() stay within the file system of the
+// tree being removed: mount points within the tree (and hence their
+// parent dirs) are left untouched and reported as ErrMountPoint.
+func WithOneFS(onefs bool) RemoveOption {
+	return func(o *removeOpt) {
+		o.onefs = onefs
+	}
+}
+
+// WithRemoveWorkers uses 'n' concurrent workers to remove the tree;
+// a value of 0 or less uses all available cpus.
+func WithRemoveWorkers(n int) RemoveOption {
+	return func(o *removeOpt) {
+		o.nworkers = n
+	}
+}
+
+type removeOpt struct {
+	onefs    bool
+	nworkers int
+}
+
+// RemoveError represents the errors returned by RemoveTree
+type RemoveError struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+// Error returns a string representation of RemoveError
+func (e *RemoveError) Error() string {
+	return fmt.Sprintf("removetree: %s '%s': %s", e.Op, e.Name, e.Err.Error())
+}
+
+// Unwrap returns the underlying wrapped error
+func (e *RemoveError) Unwrap() error {
+	return e.Err
+}
+
+var _ error = &RemoveError{}
+
+// ErrMountPoint is returned by RemoveTree() for mount points that it
+// didn't descend into.
+var ErrMountPoint = errors.New("removetree: skipping mount point")
+
+// RemoveTree removes 'nm' and all its descendants - like os.RemoveAll()
+// except the dirs are emptied concurrently. All the entries are
+// removed relative to an open fd of their parent dir; so renaming or
+// replacing a dir with a symlink while RemoveTree is running can't
+// make it remove entries outside the tree. The fd of a dir is open
+// until its sub-dirs are removed; so the number of open fds grows with
+// the depth of the tree - like os.RemoveAll(). It is not an error if
+// 'nm' - or any of its descendants - is removed by someone else while
+// RemoveTree is running. RemoveTree continues past errors and returns
+// all of them.
+func RemoveTree(nm string, opt ...RemoveOption) error {
+	var o removeOpt
+	for _, fp := range opt {
+		fp(&o)
+	}
+
+	nm = filepath.Clean(nm)
+	dir, base := filepath.Dir(nm), filepath.Base(nm)
+
+	// the caller's path to the parent of nm may have symlinks
+	pfd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return &RemoveError{"open", dir, err}
+	}
+
+	defer unix.Close(pfd)
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(pfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return &RemoveError{"lstat", nm, err}
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if err := unix.Unlinkat(pfd, base, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+			return &RemoveError{"unlink", nm, err}
+		}
+		return nil
+	}
+
+	r := &remover{
+		removeOpt: o,
+		dev:       uint64(st.Dev),
+		pfd:       pfd,
+	}
+
+	r.wp = NewWorkPool[*rmdir](o.nworkers, func(_ int, d *rmdir) error {
+		return r.empty(d)
+	}, WithExactSize(true))
+
+	r.wp.Submit(newRmdir(nil, base, nm))
+	return r.wp.Wait()
+}
+
+// remover tracks the state of a RemoveTree() operation
+type remover struct {
+	removeOpt
+
+	// device of the tree being removed
+	dev uint64
+
+	// open fd of the parent of the tree
+	pfd int
+
+	wp *WorkPool[*rmdir]
+}
+
+// rmdir is a dir that is being emptied
+type rmdir struct {
+	parent *rmdir
+
+	// name relative to the parent and the full path
+	name string
+	path string
+
+	// open fd of this dir while its sub-dirs are being removed; -1
+	// if it isn't open. The sub-dirs are opened and removed relative
+	// to it.
+	fd int
+
+	// number of sub-dirs that haven't been removed yet plus one for
+	// the listing of this dir. The dir is removed when this drops
+	// to zero.
+	pending atomic.Int64
+}
+
+func newRmdir(parent *rmdir, name, path string) *rmdir {
+	d := &rmdir{
+		parent: parent,
+		name:   name,
+		path:   path,
+		fd:     -1,
+	}
+	d.pending.Store(1)
+	return d
+}
+
+// empty removes all the entries in the dir 'd'. Its sub-dirs are
+// queued to be emptied by the workers; if the queue is full, we empty
+// them ourselves.
+func (r *remover) empty(d *rmdir) error {
+	subdirs, errs := r.scan(d)
+	for _, s := range subdirs {
+		d.pending.Add(1)
+		if ok, _ := r.wp.trySubmit(s); !ok {
+			if err := r.empty(s); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return r.done(d, errs)
+}
+
+// scan removes all the entries in the dir 'd' except its sub-dirs;
+// it returns the sub-dirs that must be emptied and removed. A dir
+// that is already gone (eg removed by a concurrent RemoveTree() of an
+// ancestor) has nothing to remove.
+func (r *remover) scan(d *rmdir) ([]*rmdir, []error) {
+	var errs []error
+
+	fd, err := openDir(r.parentFd(d), d.name)
+	if err != nil {
+		if !errors.Is(err, unix.ENOENT) {
+			errs = append(errs, &RemoveError{"open", d.path, err})
+		}
+		return nil, errs
+	}
+
+	d.fd = fd
+	names, err := readDirFd(fd)
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		errs = append(errs, &RemoveError{"readdir", d.path, err})
+	}
+
+	var subdirs []*rmdir
+	for _, nm := range names {
+		fp := d.path + "/" + nm
+
+		var st unix.Stat_t
+		if err := unix.Fstatat(fd, nm, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			if !errors.Is(err, unix.ENOENT) {
+				errs = append(errs, &RemoveError{"lstat", fp, err})
+			}
+			continue
+		}
+
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if err := unix.Unlinkat(fd, nm, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+				errs = append(errs, &RemoveError{"unlink", fp, err})
+			}
+			continue
+		}
+
+		if r.onefs && uint64(st.Dev) != r.dev {
+			errs = append(errs, &RemoveError{"rmdir", fp, ErrMountPoint})
+			continue
+		}
+
+		subdirs = append(subdirs, newRmdir(d, nm, fp))
+	}
+	return subdirs, errs
+}
+
+// done drops the listing reference of 'd' and removes it (and its
+// ancestors) if it's the last reference.
+func (r *remover) done(d *rmdir, errs []error) error {
+	for d != nil && d.pending.Add(-1) == 0 {
+		if d.fd >= 0 {
+			unix.Close(d.fd)
+			d.fd = -1
+		}
+
+		err := unix.Unlinkat(r.parentFd(d), d.name, unix.AT_REMOVEDIR)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			errs = append(errs, &RemoveError{"rmdir", d.path, err})
+		}
+
+		// we're done with the entire tree
+		if d.parent == nil {
+			r.wp.Close()
+		}
+		d = d.parent
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// parentFd returns the open fd of the parent of 'd'; the parent stays
+// open until all its sub-dirs are removed.
+func (r *remover) parentFd(d *rmdir) int {
+	if d.parent == nil {
+		return r.pfd
+	}
+	return d.parent.fd
+}
+
+// open the dir 'nm' relative to the dir fd 'dirfd' without following
+// symlinks
+func openDir(dirfd int, nm string) (int, error) {
+	for {
+		fd, err := unix.Openat(dirfd, nm, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != unix.EINTR {
+			return fd, err
+		}
+	}
+}
+
+// read the names of all the entries in the open dir 'fd'
+func readDirFd(fd int) ([]string, error) {
+	// os.File takes ownership of the fd it wraps; so we give it a dup
+	nfd, err := unix.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(nfd), "")
+	defer f.Close()
+
+	var names []string
+	for {
+		v, err := f.Readdirnames(1024)
+		names = append(names, v...)
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// removetree_test.go - tests for concurrent tree removal
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRemoveTree(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := getTmpdir(t)
+
+	// a file outside the tree that is the target of symlinks in it
+	outside := filepath.Join(tmpdir, "outside")
+	err := mkfilex(filepath.Join(outside, "keep"))
+	assert(err == nil, "mkfile: %s", err)
+
+	// a tree with a deep dir; it returns the deep dir
+	mktree := func(root string) string {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 8; j++ {
+				dn := filepath.Join(root, fmt.Sprintf("d%d", i), fmt.Sprintf("e%d", j), "f")
+				for k := 0; k < 5; k++ {
+					err := mkfilex(filepath.Join(dn, fmt.Sprintf("%03d", k)))
+					assert(err == nil, "mkfile: %s", err)
+				}
+
+				err := os.Symlink(outside, filepath.Join(dn, "link"))
+				assert(err == nil, "symlink: %s", err)
+			}
+		}
+
+		// an empty dir
+		err := os.MkdirAll(filepath.Join(root, "empty", "dir"), 0700)
+		assert(err == nil, "mkdir: %s", err)
+
+		// a deep dir; its ancestors stay open until it is removed
+		deep := root
+		for i := 0; i < 64; i++ {
+			deep = filepath.Join(deep, fmt.Sprintf("x%d", i))
+		}
+		err = mkfilex(filepath.Join(deep, "file"))
+		assert(err == nil, "mkfile: %s", err)
+		return deep
+	}
+
+	root := filepath.Join(tmpdir, "tree")
+	deep := mktree(root)
+
+	// a symlink to the tree is removed - but not the tree
+	link := filepath.Join(tmpdir, "link")
+	err = os.Symlink(root, link)
+	assert(err == nil, "symlink: %s", err)
+
+	err = RemoveTree(link)
+	assert(err == nil, "removetree: %s", err)
+
+	_, err = os.Lstat(link)
+	assert(os.IsNotExist(err), "removetree: %s still exists", link)
+	_, err = os.Stat(deep)
+	assert(err == nil, "removetree: removed the target of %s: %v", link, err)
+
+	err = RemoveTree(root, WithOneFS(true), WithRemoveWorkers(4))
+	assert(err == nil, "removetree: %s", err)
+
+	_, err = os.Lstat(root)
+	assert(os.IsNotExist(err), "removetree: %s still exists", root)
+
+	// a serial removal
+	mktree(root)
+	err = RemoveTree(root, WithRemoveWorkers(1))
+	assert(err == nil, "removetree: %s", err)
+
+	_, err = os.Lstat(root)
+	assert(os.IsNotExist(err), "removetree: %s still exists", root)
+
+	_, err = os.Stat(filepath.Join(outside, "keep"))
+	assert(err == nil, "removetree: removed file outside the tree: %v", err)
+
+	// nested dirs removed concurrently; the removal of a parent
+	// races with that of its descendants.
+	mktree(root)
+	var wg sync.WaitGroup
+	errs := make([]error, 64)
+	for i := range errs {
+		nm := root
+		for j := range i {
+			nm = filepath.Join(nm, fmt.Sprintf("x%d", j))
+		}
+
+		wg.Add(1)
+		go func(i int, nm string) {
+			errs[i] = RemoveTree(nm, WithRemoveWorkers(2))
+			wg.Done()
+		}(i, nm)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		assert(err == nil, "removetree %d: %s", i, err)
+	}
+	_, err = os.Lstat(root)
+	assert(os.IsNotExist(err), "removetree: %s still exists", root)
+
+	// missing files aren't an error
+	err = RemoveTree(root)
+	assert(err == nil, "removetree: %s", err)
+
+	// nor are plain files
+	nm := filepath.Join(outside, "keep")
+	err = RemoveTree(nm)
+	assert(err == nil, "removetree: %s", err)
+
+	_, err = os.Lstat(nm)
+	assert(os.IsNotExist(err), "removetree: %s still exists", nm)
+}
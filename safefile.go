@@ -23,6 +23,8 @@ import (
 	"strings"
 
 	"sync/atomic"
+
+	"golang.org/x/sys/unix"
 )
 
 // SafeFile is an io.WriteCloser which uses a temporary file that
@@ -48,6 +50,9 @@ type SafeFile struct {
 	err  error
 	name string // actual filename
 
+	// keep the temp file on Abort()
+	keep bool
+
 	// tracks the state of this file:
 	//  < 0 => aborted
 	//  = 0 => open and active
@@ -59,6 +64,13 @@ var _ io.WriteCloser = &SafeFile{}
 
 const (
 	OPT_OVERWRITE uint32 = 1 << iota
+
+	// Use a well known temp file name (see PartialName()) and
+	// reuse its contents if it exists. Abort() keeps the temp
+	// file around so that a subsequent attempt can resume writing.
+	// The temp file is locked while it is open; a concurrent
+	// SafeFile for the same name fails with ErrPartialInUse.
+	OPT_RESUME
 )
 
 // NewSafeFile creates a new temporary file that would either be
@@ -79,6 +91,16 @@ func NewSafeFile(nm string, opts uint32, flag int, perm os.FileMode) (*SafeFile,
 	// we need these two flags by default. The callers can set the rest..
 	flag |= os.O_CREATE | os.O_TRUNC
 
+	// keep the old file around - we don't want to destroy it if we Abort() this operation.
+	tmp := fmt.Sprintf("%s.tmp.%d.%x", nm, os.Getpid(), randU32())
+
+	// resumable files must retain the contents of previous attempts
+	resume := (opts & OPT_RESUME) > 0
+	if resume {
+		tmp = PartialName(nm)
+		flag &= ^(os.O_TRUNC | os.O_EXCL)
+	}
+
 	// make sure we don't have conflicting flags
 	if (flag & os.O_RDONLY) != 0 {
 		return nil, fmt.Errorf("safefile: %s conflicting open mode (O_RDONLY)", nm)
@@ -88,20 +110,57 @@ func NewSafeFile(nm string, opts uint32, flag int, perm os.FileMode) (*SafeFile,
 		flag |= os.O_WRONLY
 	}
 
-	// keep the old file around - we don't want to destroy it if we Abort() this operation.
-	tmp := fmt.Sprintf("%s.tmp.%d.%x", nm, os.Getpid(), randU32())
 	fd, err := os.OpenFile(tmp, flag, perm)
 	if err != nil {
 		return nil, err
 	}
 
+	if resume {
+		if err = lockPartial(fd); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+
 	sf := &SafeFile{
 		File: fd,
 		name: nm,
+		keep: resume,
 	}
 	return sf, nil
 }
 
+// PartialName returns the name of the temp file used by a
+// SafeFile opened with OPT_RESUME for the final file 'nm'.
+func PartialName(nm string) string {
+	return nm + ".partial"
+}
+
+// lock the partial file 'fd' so that concurrent writers don't clobber
+// each other; the lock is released when fd is closed.
+func lockPartial(fd *os.File) error {
+	err := unix.Flock(int(fd.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			err = ErrPartialInUse
+		}
+		return fmt.Errorf("safefile: lock %s: %w", fd.Name(), err)
+	}
+
+	// the previous owner may have committed the partial file before
+	// we got the lock; then fd isn't the partial file anymore.
+	a, err := Fstat(fd)
+	if err != nil {
+		return fmt.Errorf("safefile: lock %s: %w", fd.Name(), err)
+	}
+
+	b, err := Lstat(fd.Name())
+	if err != nil || a.Dev != b.Dev || a.Ino != b.Ino {
+		return fmt.Errorf("safefile: lock %s: %w", fd.Name(), ErrPartialInUse)
+	}
+	return nil
+}
+
 func (sf *SafeFile) isOpen() bool {
 	if n := sf.closed.Load(); n == 0 {
 		return true
@@ -176,7 +235,8 @@ func (sf *SafeFile) WriteAt(b []byte, off int64) (int, error) {
 
 // Abort the file write and remove any temporary artifacts; it is safe
 // to call Close() on a different code path; the first call to Abort() or
-// Close() takes precedence.
+// Close() takes precedence. Files opened with OPT_RESUME retain their
+// temp file.
 func (sf *SafeFile) Abort() {
 	if sf.closed.CompareAndSwap(0, -1) {
 		sf.cleanup()
@@ -188,7 +248,9 @@ func (sf *SafeFile) Abort() {
 func (sf *SafeFile) cleanup() {
 	nm := sf.Name()
 	sf.File.Close()
-	os.Remove(nm)
+	if !sf.keep {
+		os.Remove(nm)
+	}
 }
 
 // Close flushes all file data & metadata to disk, closes the file and atomically renames
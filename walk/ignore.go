@@ -0,0 +1,205 @@
+// ignore.go - gitignore style exclude rules
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ignorer is the set of ignore rules that apply to the entries of a dir;
+// a dir with its own ignore files gets a new ignorer that extends the
+// one of its parent. It is immutable once created.
+type ignorer struct {
+	// in increasing order of precedence
+	rules []rule
+}
+
+// rule is one compiled gitignore pattern
+type rule struct {
+	// path segments of the dir the pattern is relative to; empty for
+	// the root
+	base []string
+
+	// path segments of the pattern; "**" matches zero or more segments
+	segs []string
+
+	negate  bool
+	dirOnly bool
+}
+
+// newIgnorer returns the ignorer for the patterns in 'pats' that are
+// relative to the dir 'base'; the rules of 'parent' apply before them.
+func newIgnorer(parent *ignorer, base string, pats []string) (*ignorer, error) {
+	if len(pats) == 0 {
+		return parent, nil
+	}
+
+	var rules []rule
+	if parent != nil {
+		// we mustn't modify the parent's rules when we append
+		rules = slices.Clip(parent.rules)
+	}
+
+	if base == "." {
+		base = ""
+	}
+
+	var errs []string
+	for _, p := range pats {
+		r, ok, err := parseRule(base, p)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("'%s': %s", p, err))
+			continue
+		}
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+
+	ign := &ignorer{rules}
+	if len(errs) > 0 {
+		return ign, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return ign, nil
+}
+
+// parse a gitignore pattern; it returns false if the line is not a
+// pattern (eg a comment).
+func parseRule(base, p string) (rule, bool, error) {
+	var r rule
+	if len(base) > 0 {
+		r.base = strings.Split(base, "/")
+	}
+
+	p = trimSpace(p)
+	if len(p) == 0 || p[0] == '#' {
+		return r, false, nil
+	}
+
+	switch {
+	case p[0] == '!':
+		r.negate = true
+		p = p[1:]
+	case strings.HasPrefix(p, `\!`), strings.HasPrefix(p, `\#`):
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	// a pattern without a slash matches at any depth; otherwise it
+	// is relative to base.
+	if !strings.Contains(p, "/") {
+		p = "**/" + p
+	}
+	p = strings.TrimPrefix(p, "/")
+	if len(p) == 0 {
+		return r, false, nil
+	}
+
+	r.segs = strings.Split(p, "/")
+	for _, s := range r.segs {
+		if _, err := path.Match(s, ""); err != nil {
+			return r, false, err
+		}
+	}
+	return r, true, nil
+}
+
+// trim the trailing spaces of 'p' unless they're escaped
+func trimSpace(p string) string {
+	p = strings.TrimSuffix(p, "\r")
+	for strings.HasSuffix(p, " ") && !strings.HasSuffix(p, `\ `) {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// ignored returns true if the entry with the root-relative path 'rel'
+// must be excluded; the last rule that matches it decides.
+func (ign *ignorer) ignored(rel string, isDir bool) bool {
+	if ign == nil {
+		return false
+	}
+
+	segs := strings.Split(rel, "/")
+	for i := len(ign.rules) - 1; i >= 0; i-- {
+		r := &ign.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+
+		// the pattern only applies to the entries below its base
+		n := len(r.base)
+		if len(segs) <= n || !slices.Equal(segs[:n], r.base) {
+			continue
+		}
+		if matchSegs(r.segs, segs[n:]) {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// match the path segments 's' against the pattern segments 'p'
+func matchSegs(p, s []string) bool {
+	for len(p) > 0 {
+		if p[0] == "**" {
+			// a trailing '**' matches everything inside - but not
+			// the dir itself.
+			if len(p) == 1 {
+				return len(s) > 0
+			}
+
+			for i := range len(s) + 1 {
+				if matchSegs(p[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(s) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(p[0], s[0]); !ok {
+			return false
+		}
+		p, s = p[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// readIgnoreFile returns the patterns in the ignore file 'nm'
+func readIgnoreFile(nm string) ([]string, error) {
+	b, err := os.ReadFile(nm)
+	if err != nil {
+		return nil, err
+	}
+
+	var pats []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		pats = append(pats, sc.Text())
+	}
+	return pats, sc.Err()
+}
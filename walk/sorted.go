@@ -0,0 +1,127 @@
+// sorted.go - deterministic walks in lexical order
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/opencoff/go-fio"
+)
+
+// A sorted walk has a single emitter that outputs the entries in order
+// while the workers read dirs ahead of it. The emitter queues the next
+// few subdirs of a dir - at most Concurrency of them - ahead of the one
+// it is outputting; so the workers can read them while the emitter is
+// busy with the entries that precede them. The memory used is bounded by
+// the entries of the dirs on the path from the root to the dir being
+// output, and of up to Concurrency read-ahead subdirs of each.
+
+// entry is a dir entry in a sorted walk
+type entry struct {
+	name    string
+	fi      *fio.Info
+	descend bool
+}
+
+// walkSorted outputs the entries of 'root' and their descendants in
+// order from a separate go-routine
+func (d *walkState) walkSorted(root *wdir) {
+	root.done = make(chan struct{})
+	close(root.done)
+
+	d.dirWg.Add(1)
+	go func() {
+		d.emit(root)
+		d.dirWg.Done()
+	}()
+}
+
+// queue the dir 'fi' to be read by the workers; 'ign' are the ignore
+// rules of its parent.
+func (d *walkState) queue(fi *fio.Info, ign *ignorer) *wdir {
+	w := newWdir(fi, ign)
+	w.done = make(chan struct{})
+
+	if d.wp.Submit(w) != nil {
+		close(w.done)
+	}
+	return w
+}
+
+// scanSorted reads the dir 'w' and sorts its entries
+func (d *walkState) scanSorted(w *wdir) {
+	defer close(w.done)
+
+	// discard the pending dirs of a cancelled walk
+	if d.ctx.Err() != nil {
+		return
+	}
+
+	d.scanDir(w, func(name string, fi *fio.Info, descend bool) {
+		w.entries = append(w.entries, entry{name, fi, descend})
+	})
+
+	slices.SortFunc(w.entries, func(a, b entry) int {
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// emit outputs the entries of 'w' in order and descends into its subdirs
+func (d *walkState) emit(w *wdir) {
+	<-w.done
+
+	// pick the subdirs we haven't seen before; they're read ahead in
+	// order - a few at a time.
+	var pick []int
+	for i := range w.entries {
+		e := &w.entries[i]
+		if e.descend && !d.isEntrySeen(e.fi) {
+			pick = append(pick, i)
+		}
+	}
+
+	subdirs := make([]*wdir, len(w.entries))
+	var next int
+	readAhead := func(n int) {
+		for ; next < min(n, len(pick)); next++ {
+			i := pick[next]
+			subdirs[i] = d.queue(w.entries[i].fi, w.ign)
+		}
+	}
+
+	var k int
+	readAhead(d.Concurrency)
+	for i := range w.entries {
+		if d.ctx.Err() != nil {
+			return
+		}
+
+		e := &w.entries[i]
+		switch {
+		case k < len(pick) && pick[k] == i:
+			k++
+			readAhead(k + d.Concurrency)
+			d.output(e.fi)
+			d.emit(subdirs[i])
+			subdirs[i] = nil
+
+		case e.descend:
+			// a dir we've seen before
+
+		case !d.isEntrySeen(e.fi):
+			d.output(e.fi)
+		}
+	}
+}
@@ -22,16 +22,20 @@
 package walk
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"iter"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/opencoff/go-fio"
+	"github.com/opencoff/go-fio/internal/walkinfo"
 )
 
 // High level design:
@@ -64,6 +68,12 @@ type Options struct {
 	// Walk() will use the max available cpus
 	Concurrency int
 
+	// If set (ie > 0), the number of go-routines adapts to the
+	// observed throughput - between MinConcurrency and Concurrency.
+	// This is useful for slow or network file systems where the
+	// best concurrency isn't known in advance. See fio.WithAdaptive().
+	MinConcurrency int
+
 	// Follow symlinks if set
 	FollowSymlinks bool
 
@@ -85,17 +95,52 @@ type Options struct {
 	// The matching is done on the basename component of the pathname.
 	Excludes []string
 
+	// Ignore is a list of gitignore(5) style patterns to exclude from
+	// the traversal: patterns with a slash are anchored to the root of
+	// the walk, "**" matches any number of dirs, a trailing "/" matches
+	// only dirs and a leading "!" includes entries that an earlier
+	// pattern excluded. Like Excludes, excluded dirs are not descended.
+	// With FollowSymlinks, a symlink is matched as the entry it points
+	// to. Invalid patterns are reported as errors; the rest still apply.
+	Ignore []string
+
+	// IgnoreFiles names the per-directory files (eg ".gitignore") whose
+	// patterns are applied to the entries of the dir they're in and its
+	// descendants. Patterns in deeper dirs take precedence over those
+	// in their parents, which take precedence over Ignore.
+	IgnoreFiles []string
+
 	// Filter is an optional caller provided callback to similarly
 	// exclude entries from further traversal.
 	// This function must return True if this entry should
 	// no longer be processed. ie filtered out.
 	Filter func(fi *fio.Info) (bool, error)
+
+	// MaxDepth stops the walk from descending below dirs at this depth;
+	// the roots are at depth 0 and their entries are at depth 1. A
+	// value of 0 walks the entire tree; a negative value only returns
+	// the roots (like find -maxdepth 0).
+	MaxDepth int
+
+	// MinDepth suppresses the output of the entries above this depth;
+	// they are still walked. Each entry's depth and root-relative path
+	// are available via fio.Info.Depth() and fio.Info.RelPath() - both
+	// in Filter and in the output.
+	MinDepth int
+
+	// Sorted returns the entries in a deterministic order: a depth-first
+	// pre-order traversal where the entries of each dir are in lexical
+	// order. The roots are walked in the order given. Dirs are still
+	// read concurrently - but only a few subdirs of each dir being
+	// output are read ahead.
+	Sorted bool
 }
 
 // internal state
 type walkState struct {
 	Options
-	ch    chan string
+	ctx   context.Context
+	wp    *fio.WorkPool[*wdir]
 	out   chan *fio.Info
 	errch chan error
 
@@ -107,8 +152,8 @@ type walkState struct {
 	// we've encountered.
 	dirWg sync.WaitGroup
 
-	// Tracks worker goroutines
-	wg sync.WaitGroup
+	// ignore rules for the roots
+	ign *ignorer
 
 	// functions that make our filtering easier
 	filterName func(nm string) bool
@@ -124,6 +169,34 @@ type walkState struct {
 	ino sync.Map
 }
 
+// wdir is a dir queued for the workers
+type wdir struct {
+	nm string
+
+	// path relative to the root of the walk and its depth
+	rel   string
+	depth int
+
+	// ignore rules for the entries of this dir
+	ign *ignorer
+
+	// for sorted walks: the sorted entries of the dir; they're valid
+	// once done is closed.
+	done    chan struct{}
+	entries []entry
+}
+
+// newWdir returns the dir 'fi' to be queued for the workers; 'ign' are
+// the ignore rules of its parent.
+func newWdir(fi *fio.Info, ign *ignorer) *wdir {
+	return &wdir{
+		nm:    fi.Path(),
+		rel:   fi.RelPath(),
+		depth: fi.Depth(),
+		ign:   ign,
+	}
+}
+
 // mapping our types to the stdlib types
 var typMap = map[Type]os.FileMode{
 	FILE:    0,
@@ -156,16 +229,30 @@ func (t Type) String() string {
 // results in a channel of *fio.Info. The caller must service the channel. Any errors
 // encountered during the walk are returned in the error channel.
 func Walk(names []string, opt Options) (chan *fio.Info, chan error) {
+	return WalkContext(context.Background(), names, opt)
+}
+
+// WalkContext is like Walk - except the walk stops when 'ctx' is cancelled:
+// no new directories are read, the pending ones are discarded and both
+// channels are closed once the workers are done. Entries and errors that
+// the caller doesn't read after the cancellation are dropped; so the caller
+// can stop reading the channels once it cancels 'ctx'. The context's
+// error is always the last error sent on the error channel; it displaces
+// the oldest unread error if the channel is full.
+func WalkContext(ctx context.Context, names []string, opt Options) (chan *fio.Info, chan error) {
 	if opt.Concurrency <= 0 {
 		opt.Concurrency = runtime.NumCPU()
 	}
 
 	out := make(chan *fio.Info, opt.Concurrency)
-	d := newWalkState(opt)
+	d := newWalkState(ctx, opt)
 
 	// This function sends output to a chan
 	d.apply = func(fi *fio.Info) {
-		out <- fi
+		select {
+		case out <- fi:
+		case <-ctx.Done():
+		}
 	}
 
 	d.doWalk(names)
@@ -173,28 +260,119 @@ func Walk(names []string, opt Options) (chan *fio.Info, chan error) {
 	// close the channels when we're all done
 	go func() {
 		d.dirWg.Wait()
-		close(d.ch)
+		d.wp.Close()
+		if err := d.wp.Wait(); err != nil {
+			d.error(err)
+		}
+
+		// we're the only sender now; the caller may have stopped
+		// reading errch - so make room for the context error by
+		// dropping the oldest unread error.
+		if err := ctx.Err(); err != nil {
+			for sent := false; !sent; {
+				select {
+				case d.errch <- err:
+					sent = true
+				default:
+					select {
+					case <-d.errch:
+					default:
+					}
+				}
+			}
+		}
 		close(out)
 		close(d.errch)
-		d.wg.Wait()
 	}()
 
 	return out, d.errch
 }
 
+// All returns an iterator over the entries in 'names' that match the
+// criteria in 'opt'; the walk is concurrent like Walk(). Errors are
+// returned with a nil *fio.Info and the iteration continues past them.
+// Breaking out of the iteration stops the walk and waits for all its
+// workers to finish. If 'ctx' is cancelled, the iteration ends with
+// the context's error.
+func All(ctx context.Context, names []string, opt Options) iter.Seq2[*fio.Info, error] {
+	return func(yield func(*fio.Info, error) bool) {
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		och, ech := WalkContext(wctx, names, opt)
+
+		// the channels are closed only after the workers are done
+		stop := func() {
+			cancel()
+			if och != nil {
+				for range och {
+				}
+			}
+			if ech != nil {
+				for range ech {
+				}
+			}
+		}
+
+		for och != nil || ech != nil {
+			select {
+			case fi, ok := <-och:
+				if !ok {
+					och = nil
+					continue
+				}
+				if !yield(fi, nil) {
+					stop()
+					return
+				}
+
+			case err, ok := <-ech:
+				if !ok {
+					ech = nil
+					continue
+				}
+
+				// we report the context error once at the end
+				if cerr := ctx.Err(); cerr != nil && errors.Is(err, cerr) {
+					continue
+				}
+				if !yield(nil, err) {
+					stop()
+					return
+				}
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
 // WalkFunc traverses the entries in 'names' in a concurrent fashion and calls 'apply'
 // for entries that match criteria in 'opt'. The apply function must be concurrency-safe
 // ie it will be called concurrently from multiple go-routines. Any errors reported by
 // 'apply' will be returned from WalkFunc().
 func WalkFunc(names []string, opt Options, apply func(fi *fio.Info) error) error {
+	return WalkFuncContext(context.Background(), names, opt, apply)
+}
+
+// WalkFuncContext is like WalkFunc - except the walk stops when 'ctx' is
+// cancelled: no new directories are read and 'apply' isn't called for
+// the entries that remain. It returns the context's error along with
+// any other errors seen before the cancellation.
+func WalkFuncContext(ctx context.Context, names []string, opt Options, apply func(fi *fio.Info) error) error {
 	if opt.Concurrency <= 0 {
 		opt.Concurrency = runtime.NumCPU()
 	}
 
-	d := newWalkState(opt)
+	d := newWalkState(ctx, opt)
 
 	// This calls the caller supplied 'apply' func
 	d.apply = func(fi *fio.Info) {
+		if ctx.Err() != nil {
+			return
+		}
 		if err := apply(fi); err != nil {
 			d.errch <- err
 		}
@@ -216,10 +394,16 @@ func WalkFunc(names []string, opt Options, apply func(fi *fio.Info) error) error
 
 	// close the channels when we're all done
 	d.dirWg.Wait()
-	close(d.ch)
+	d.wp.Close()
+	if err := d.wp.Wait(); err != nil {
+		d.errch <- err
+	}
 	close(d.errch)
 	errWg.Wait()
-	d.wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
 
 	if len(errs) > 0 {
 		return errors.Join(errs...)
@@ -227,10 +411,10 @@ func WalkFunc(names []string, opt Options, apply func(fi *fio.Info) error) error
 	return nil
 }
 
-func newWalkState(opt Options) *walkState {
+func newWalkState(ctx context.Context, opt Options) *walkState {
 	d := &walkState{
 		Options: opt,
-		ch:      make(chan string, opt.Concurrency),
+		ctx:     ctx,
 		errch:   make(chan error, opt.Concurrency),
 
 		filterName: func(_ string) bool {
@@ -266,20 +450,42 @@ func newWalkState(opt Options) *walkState {
 		}
 	}
 
-	// create workers
-	d.wg.Add(d.Concurrency)
-	for i := 0; i < d.Concurrency; i++ {
-		go d.worker()
+	// create workers; the pool isn't cancelled with ctx because every
+	// queued dir must reach a worker to be accounted in dirWg.
+	wopt := []fio.WorkPoolOption{fio.WithExactSize(true)}
+	if d.MinConcurrency > 0 {
+		wopt = append(wopt, fio.WithAdaptive(d.MinConcurrency))
 	}
+
+	d.wp = fio.NewWorkPool[*wdir](d.Concurrency, func(_ int, w *wdir) error {
+		if d.Sorted {
+			d.scanSorted(w)
+		} else {
+			d.worker(w)
+		}
+		return nil
+	}, wopt...)
 	return d
 }
 
 // walk the entries in 'names'; this creates workers to
 // traverse the FS in a concurrent fashion.
 func (d *walkState) doWalk(names []string) {
-	// send work to workers
-	dirs := make([]string, 0, len(names))
+	// a bad pattern doesn't void the valid ones
+	var err error
+	if d.ign, err = newIgnorer(nil, "", d.Ignore); err != nil {
+		d.error(&Error{"ignore", strings.Join(d.Ignore, " "), err})
+	}
+
+	// send work to workers; a sorted walk outputs the roots via
+	// the entries of a dir that has no name of its own.
+	root := &wdir{ign: d.ign}
+	dirs := make([]*wdir, 0, len(names))
 	for i := range names {
+		if d.ctx.Err() != nil {
+			break
+		}
+
 		nm := strings.TrimSuffix(names[i], "/")
 		if len(nm) == 0 {
 			nm = "/"
@@ -294,9 +500,10 @@ func (d *walkState) doWalk(names []string) {
 			d.error(&Error{"lstat", nm, err})
 			continue
 		}
+		walkinfo.SetRelPath(fi, ".", 0)
 
 		// don't process entries we've already seen
-		if d.isEntrySeen(fi) {
+		if d.seen(fi) {
 			continue
 		}
 
@@ -310,55 +517,78 @@ func (d *walkState) doWalk(names []string) {
 		}
 
 		m := fi.Mode()
+		if m.IsDir() && d.OneFS {
+			d.trackFS(fi)
+		}
+
+		visit := func(fi *fio.Info, descend bool) {
+			switch {
+			case d.Sorted:
+				root.entries = append(root.entries, entry{nm, fi, descend})
+			case descend:
+				dirs = append(dirs, newWdir(fi, d.ign))
+			default:
+				d.output(fi)
+			}
+		}
+
 		switch {
 		case m.IsDir():
-			if d.OneFS {
-				d.trackFS(fi)
-			}
-			dirs = append(dirs, nm)
+			visit(fi, d.canDescend(fi))
 
 		case (m & os.ModeSymlink) > 0:
 			// we may have new info now. The symlink may point to file, dir or
 			// special.
-			dirs = d.doSymlink(fi, dirs)
+			if fi, descend, ok := d.doSymlink(fi, nil); ok {
+				visit(fi, descend && d.canDescend(fi))
+			}
 
 		default:
-			d.output(fi)
+			visit(fi, false)
 		}
 	}
 
+	if d.Sorted {
+		d.walkSorted(root)
+		return
+	}
+
 	// queue the dirs
 	d.enq(dirs)
-
 }
 
-// worker thread to walk directories
-func (d *walkState) worker() {
-	for nm := range d.ch {
-		fi := d.newInfo()
-		if err := fio.Lstatm(nm, fi); err != nil {
-			d.error(&Error{"lstat-wrk", nm, err})
-			d.dirWg.Done()
-			continue
-		}
+// worker to walk the directory 'w'
+func (d *walkState) worker(w *wdir) {
+	// It is crucial that we do this as the last thing in the worker.
+	// Otherwise, we have a race condition where the workers will prematurely quit.
+	// We can only decrement this wait-group _after_ walkPath() has returned!
+	defer d.dirWg.Done()
 
-		// we are _sure_ this is a dir.
-		d.output(fi)
-
-		// Now process the contents of this dir
-		d.walkPath(nm)
+	// discard the pending dirs of a cancelled walk
+	if d.ctx.Err() != nil {
+		return
+	}
 
-		// It is crucial that we do this as the last thing in the processing loop.
-		// Otherwise, we have a race condition where the workers will prematurely quit.
-		// We can only decrement this wait-group _after_ walkPath() has returned!
-		d.dirWg.Done()
+	fi := d.newInfo()
+	if err := fio.Lstatm(w.nm, fi); err != nil {
+		d.error(&Error{"lstat-wrk", w.nm, err})
+		return
 	}
+	walkinfo.SetRelPath(fi, w.rel, w.depth)
+
+	// we are _sure_ this is a dir.
+	d.output(fi)
 
-	d.wg.Done()
+	// Now process the contents of this dir
+	d.walkPath(w)
 }
 
 // output action for entries we encounter
 func (d *walkState) output(fi *fio.Info) {
+	if fi.Depth() < d.MinDepth {
+		return
+	}
+
 	m := fi.Mode()
 
 	// we have to special case regular files because there is
@@ -388,12 +618,14 @@ func (d *walkState) exclude(nm string) bool {
 
 // enqueue a list of dirs in a separate go-routine so the caller is
 // not blocked (deadlocked)
-func (d *walkState) enq(dirs []string) {
+func (d *walkState) enq(dirs []*wdir) {
 	if len(dirs) > 0 {
 		d.dirWg.Add(len(dirs))
-		go func(dirs []string) {
-			for _, nm := range dirs {
-				d.ch <- nm
+		go func(dirs []*wdir) {
+			for _, w := range dirs {
+				if d.wp.Submit(w) != nil {
+					d.dirWg.Done()
+				}
 			}
 		}(dirs)
 	}
@@ -414,28 +646,67 @@ func readDir(nm string) ([]string, error) {
 	return names, nil
 }
 
-// Process a directory and return the list of subdirs
+// Process a directory and queue its subdirs
 //
-// There is *no* race condition between the workers reading d.ch and the
+// There is *no* race condition between the workers reading d.wp and the
 // wait-group going to zero: there is at least 1 count outstanding: of the
 // current entry being processed. So, this function can take as long as it wants
 // the caller (d.worker()) won't decrement that wait-count until this function
 // returns. And by then the wait-count would've been bumped up by the number of
 // dirs we've seen here.
-func (d *walkState) walkPath(nm string) {
+func (d *walkState) walkPath(w *wdir) {
+	dirs := make([]*wdir, 0, 8)
+	d.scanDir(w, func(_ string, fi *fio.Info, descend bool) {
+		if descend {
+			dirs = append(dirs, newWdir(fi, w.ign))
+		} else {
+			d.output(fi)
+		}
+	})
+
+	d.enq(dirs)
+}
+
+// read the directory 'w' and call 'visit' for each entry that passes
+// the filters - in the order they are read. 'visit' gets the name of
+// the entry within 'w' and its info; descend is true for the dirs
+// that must be walked. The ignore rules of 'w' are extended with the
+// ignore files in it.
+func (d *walkState) scanDir(w *wdir, visit func(name string, fi *fio.Info, descend bool)) {
+	nm := w.nm
 	names, err := readDir(nm)
 	if err != nil {
 		d.error(err)
 		return
 	}
 
+	for _, fn := range d.IgnoreFiles {
+		if !slices.Contains(names, fn) {
+			continue
+		}
+
+		fp := path.Join(nm, fn)
+		pats, err := readIgnoreFile(fp)
+		if err != nil {
+			d.error(&Error{"ignore", fp, err})
+			continue
+		}
+
+		if w.ign, err = newIgnorer(w.ign, w.rel, pats); err != nil {
+			d.error(&Error{"ignore", fp, err})
+		}
+	}
+
 	// hack to make joined paths not look like '//file'
 	if nm == "/" {
 		nm = ""
 	}
 
-	dirs := make([]string, 0, len(names)/2)
 	for i := range names {
+		if d.ctx.Err() != nil {
+			return
+		}
+
 		entry := names[i]
 
 		// we don't want to use filepath.Join() because it "cleans"
@@ -452,9 +723,17 @@ func (d *walkState) walkPath(nm string) {
 			d.error(&Error{"lstat", fp, err})
 			continue
 		}
+		walkinfo.SetRelPath(fi, path.Join(w.rel, entry), w.depth+1)
+
+		// a followed symlink is matched once it is resolved (in
+		// doSymlink); so the dir-only rules apply to symlinked dirs.
+		m := fi.Mode()
+		if (m&os.ModeSymlink == 0 || !d.FollowSymlinks) && w.ign.ignored(fi.RelPath(), fi.IsDir()) {
+			continue
+		}
 
 		// don't process entries we've already seen
-		if d.isEntrySeen(fi) {
+		if d.seen(fi) {
 			//fmt.Printf("%s: +dup-inode\n", fp)
 			continue
 		}
@@ -468,34 +747,33 @@ func (d *walkState) walkPath(nm string) {
 			continue
 		}
 
-		m := fi.Mode()
 		switch {
 		case m.IsDir():
 			// don't descend if this directory is not on the same file system.
 			if d.singlefs(fi) {
-				dirs = append(dirs, fp)
+				visit(entry, fi, d.canDescend(fi))
 			}
 
 		case (m & os.ModeSymlink) > 0:
 			// we may have new info now. The symlink may point to file, dir or
 			// special.
-			dirs = d.doSymlink(fi, dirs)
+			if fi, descend, ok := d.doSymlink(fi, w.ign); ok {
+				visit(entry, fi, descend && d.canDescend(fi))
+			}
 
 		default:
-			d.output(fi)
+			visit(entry, fi, false)
 		}
 	}
-
-	d.enq(dirs)
 }
 
-// Walk symlinks and don't process dirs/entries that we've already seen
-// This function updates dirs if the resolved symlink is a dir we have
-// to descend - and returns the possibly updated dirs list.
-func (d *walkState) doSymlink(fi *fio.Info, dirs []string) []string {
+// Walk symlinks and don't process dirs/entries that we've already seen or
+// that match the ignore rules 'ign'. This function returns the info of the
+// entry to process and true if it is a dir we have to descend; it returns
+// false for 'ok' if there is nothing to process.
+func (d *walkState) doSymlink(fi *fio.Info, ign *ignorer) (_ *fio.Info, descend bool, ok bool) {
 	if !d.FollowSymlinks {
-		d.output(fi)
-		return dirs
+		return fi, false, true
 	}
 
 	// process symlinks until we are done
@@ -503,31 +781,46 @@ func (d *walkState) doSymlink(fi *fio.Info, dirs []string) []string {
 	newnm, err := filepath.EvalSymlinks(nm)
 	if err != nil {
 		d.error(&Error{"symlink", nm, err})
-		return dirs
+		return nil, false, false
 	}
 	nm = newnm
 
-	// we know this is no longer a symlink
+	// we know this is no longer a symlink; the entry is still
+	// where the symlink is in the tree.
+	rel, depth := fi.RelPath(), fi.Depth()
 	if err = fio.Statm(nm, fi); err != nil {
 		d.error(&Error{"symlink-stat", nm, err})
-		return dirs
+		return nil, false, false
+	}
+	walkinfo.SetRelPath(fi, rel, depth)
+
+	if ign.ignored(rel, fi.IsDir()) {
+		return nil, false, false
 	}
 
 	// do rest of processing iff we haven't seen this entry before.
-	if !d.isEntrySeen(fi) {
-		switch {
-		case fi.Mode().IsDir():
-			// Check if we crossed mountpoints after symlink
-			// resolution.
-			if d.singlefs(fi) {
-				dirs = append(dirs, nm)
-			}
-		default:
-			d.output(fi)
-		}
+	if d.seen(fi) {
+		return nil, false, false
 	}
 
-	return dirs
+	if fi.Mode().IsDir() {
+		// Check if we crossed mountpoints after symlink
+		// resolution.
+		return fi, true, d.singlefs(fi)
+	}
+	return fi, false, true
+}
+
+// return true if we can descend into the dir 'fi'
+func (d *walkState) canDescend(fi *fio.Info) bool {
+	return d.MaxDepth == 0 || fi.Depth() < d.MaxDepth
+}
+
+// return true if we've seen this inode before; a sorted walk tracks
+// the inodes as they are output - so the first entry in the sorted
+// order wins.
+func (d *walkState) seen(fi *fio.Info) bool {
+	return !d.Sorted && d.isEntrySeen(fi)
 }
 
 // track this inode to detect loops; return true if we've seen it before
@@ -574,7 +867,10 @@ func (d *walkState) isSingleFS(fi *fio.Info) bool {
 
 // enq an error
 func (d *walkState) error(e error) {
-	d.errch <- e
+	select {
+	case d.errch <- e:
+	case <-d.ctx.Done():
+	}
 }
 
 // TODO mem pool for info
@@ -3,15 +3,21 @@
 package walk
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/opencoff/go-fio"
 )
 
 type test struct {
@@ -82,6 +88,371 @@ func TestWalkSimple(t *testing.T) {
 	//os.RemoveAll(tmpdir)
 }
 
+// walk with a single worker and an adaptive number of workers
+func TestWalkConcurrency(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := t.TempDir()
+	err := mkTestDir(tmpdir)
+	assert(err == nil, "mktmp: %s", err)
+
+	tx := &test{tmpdir, ALL}
+	want, err := oldWalk(tx)
+	assert(err == nil, "old-walk: %s", err)
+
+	opts := []Options{
+		{Concurrency: 1, Type: ALL},
+		{Concurrency: 8, MinConcurrency: 1, Type: ALL},
+	}
+
+	for _, opt := range opts {
+		var mu sync.Mutex
+		seen := make(map[string]bool)
+		err := WalkFunc([]string{tmpdir}, opt, func(fi *fio.Info) error {
+			mu.Lock()
+			seen[fi.Path()] = true
+			mu.Unlock()
+			return nil
+		})
+		assert(err == nil, "walk %d/%d: %s", opt.MinConcurrency, opt.Concurrency, err)
+		assert(len(seen) == len(want), "walk %d/%d: exp %d entries, saw %d",
+			opt.MinConcurrency, opt.Concurrency, len(want), len(seen))
+		for k := range want {
+			assert(seen[k], "walk %d/%d: missing %s", opt.MinConcurrency, opt.Concurrency, k)
+		}
+	}
+}
+
+// cancel walks midway
+func TestWalkCancel(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := t.TempDir()
+
+	for i := range 20 {
+		for j := range 20 {
+			err := mkfile(tmpdir, fmt.Sprintf("d%02d/e%02d/f", i, j))
+			assert(err == nil, "mkfile: %s", err)
+		}
+	}
+
+	opt := Options{Concurrency: 4, Type: ALL}
+
+	// stop reading the channels after the first entry
+	ctx, cancel := context.WithCancel(context.Background())
+	och, ech := WalkContext(ctx, []string{tmpdir}, opt)
+	<-och
+	cancel()
+
+	time.Sleep(10 * time.Millisecond)
+
+	var n int
+	for range och {
+		n++
+	}
+
+	var err error
+	for e := range ech {
+		err = errors.Join(err, e)
+	}
+	assert(n < 800, "exp walk to stop; saw %d entries", n)
+	assert(errors.Is(err, context.Canceled), "exp cancel, saw %v", err)
+
+	// the context error isn't lost when the error chan is full
+	errBad := errors.New("bad entry")
+	eopt := opt
+	eopt.Filter = func(fi *fio.Info) (bool, error) {
+		if fi.Path() != tmpdir {
+			return true, errBad
+		}
+		return false, nil
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	och, ech = WalkContext(ctx, []string{tmpdir}, eopt)
+	<-och
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	for range och {
+	}
+
+	var last error
+	for e := range ech {
+		last = e
+	}
+	assert(errors.Is(last, context.Canceled), "exp cancel last, saw %v", last)
+
+	// cancel from within the apply func
+	var seen atomic.Int64
+	ctx, cancel = context.WithCancel(context.Background())
+	err = WalkFuncContext(ctx, []string{tmpdir}, opt, func(fi *fio.Info) error {
+		if seen.Add(1) == 10 {
+			cancel()
+		}
+		return nil
+	})
+	assert(errors.Is(err, context.Canceled), "exp cancel, saw %v", err)
+	assert(seen.Load() < 800, "exp walk to stop; saw %d entries", seen.Load())
+}
+
+// iterate over walks
+func TestWalkAll(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := t.TempDir()
+
+	for i := range 20 {
+		for j := range 20 {
+			err := mkfile(tmpdir, fmt.Sprintf("d%02d/e%02d/f", i, j))
+			assert(err == nil, "mkfile: %s", err)
+		}
+	}
+
+	opt := Options{Concurrency: 4, Type: FILE}
+
+	var n int
+	for fi, err := range All(context.Background(), []string{tmpdir}, opt) {
+		assert(err == nil, "walk: %s", err)
+		assert(fi.Mode().IsRegular(), "%s: exp file, saw %s", fi.Path(), fi.Mode())
+		n++
+	}
+	assert(n == 400, "exp 400 files, saw %d", n)
+
+	// breaking out must stop all the workers
+	ngo := runtime.NumGoroutine()
+	for range 10 {
+		for _, err := range All(context.Background(), []string{tmpdir}, opt) {
+			assert(err == nil, "walk: %s", err)
+			break
+		}
+	}
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > ngo; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert(runtime.NumGoroutine() <= ngo, "leaked goroutines: exp %d, saw %d", ngo, runtime.NumGoroutine())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var err error
+	for _, e := range All(ctx, []string{tmpdir}, opt) {
+		err = e
+	}
+	assert(errors.Is(err, context.Canceled), "exp cancel, saw %v", err)
+}
+
+// sorted walks must match the order of filepath.WalkDir
+func TestWalkSorted(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := t.TempDir()
+
+	for i := range 10 {
+		for j := range 10 {
+			err := mkfile(tmpdir, fmt.Sprintf("d%d/e%02d/f%d", i%3, j, i))
+			assert(err == nil, "mkfile: %s", err)
+		}
+	}
+	err := mkTestDir(tmpdir)
+	assert(err == nil, "mktmp: %s", err)
+
+	// only the first of the hardlinks in lexical order must be output
+	err = os.Link(filepath.Join(tmpdir, "d2/e09/f8"), filepath.Join(tmpdir, "d0/link"))
+	assert(err == nil, "link: %s", err)
+
+	var want []string
+	err = filepath.WalkDir(tmpdir, func(p string, de fs.DirEntry, err error) error {
+		if err == nil && p != filepath.Join(tmpdir, "d2/e09/f8") {
+			want = append(want, p)
+		}
+		return err
+	})
+	assert(err == nil, "walkdir: %s", err)
+
+	opt := Options{
+		Concurrency:          8,
+		Type:                 ALL,
+		Sorted:               true,
+		IgnoreDuplicateInode: true,
+	}
+
+	// the small pools read ahead fewer subdirs than a dir has
+	for _, ncpu := range []int{1, 2, 8, 8, 8} {
+		opt.Concurrency = ncpu
+
+		var got []string
+		for fi, err := range All(context.Background(), []string{tmpdir}, opt) {
+			assert(err == nil, "walk: %s", err)
+			got = append(got, fi.Path())
+		}
+
+		assert(len(got) == len(want), "%d: exp %d entries, saw %d", ncpu, len(want), len(got))
+		for i := range want {
+			assert(got[i] == want[i], "%d: %d: exp %s, saw %s", ncpu, i, want[i], got[i])
+		}
+	}
+
+	// stop a sorted walk midway
+	var n int
+	for _, err := range All(context.Background(), []string{tmpdir}, opt) {
+		assert(err == nil, "walk: %s", err)
+		if n++; n == 3 {
+			break
+		}
+	}
+}
+
+// walk with depth limits
+func TestWalkDepth(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := t.TempDir()
+
+	err := mkfile(tmpdir, "a/b/c/d/e")
+	assert(err == nil, "mkfile: %s", err)
+	err = mkfile(tmpdir, "a/f")
+	assert(err == nil, "mkfile: %s", err)
+
+	tests := []struct {
+		min, max int
+		want     []string
+	}{
+		{0, 0, []string{".", "a", "a/b", "a/b/c", "a/b/c/d", "a/b/c/d/e", "a/f"}},
+		{0, 2, []string{".", "a", "a/b", "a/f"}},
+		{2, 3, []string{"a/b", "a/b/c", "a/f"}},
+		{1, 1, []string{"a"}},
+		{0, -1, []string{"."}},
+	}
+
+	for _, tx := range tests {
+		for _, sorted := range []bool{false, true} {
+			var mu sync.Mutex
+			var filtered []string
+
+			opt := Options{
+				Type:     ALL,
+				MinDepth: tx.min,
+				MaxDepth: tx.max,
+				Sorted:   sorted,
+				Filter: func(fi *fio.Info) (bool, error) {
+					mu.Lock()
+					filtered = append(filtered, fi.RelPath())
+					mu.Unlock()
+					return false, nil
+				},
+			}
+
+			var got []string
+			for fi, err := range All(context.Background(), []string{tmpdir}, opt) {
+				assert(err == nil, "walk: %s", err)
+
+				rel := fi.RelPath()
+				exp := filepath.Join(tmpdir, rel)
+				assert(fi.Path() == exp, "%s: exp path %s, saw %s", rel, exp, fi.Path())
+
+				depth := 0
+				if rel != "." {
+					depth = strings.Count(rel, "/") + 1
+				}
+				assert(fi.Depth() == depth, "%s: exp depth %d, saw %d", rel, depth, fi.Depth())
+				got = append(got, rel)
+			}
+
+			if !sorted {
+				slices.Sort(got)
+			}
+			assert(slices.Equal(got, tx.want), "depth %d-%d: exp %v, saw %v", tx.min, tx.max, tx.want, got)
+
+			// entries below the max depth are never seen
+			for _, rel := range filtered {
+				assert(tx.max == 0 || rel == "." || strings.Count(rel, "/") < tx.max, "depth %d-%d: filtered %s", tx.min, tx.max, rel)
+			}
+		}
+	}
+}
+
+func TestWalkIgnore(t *testing.T) {
+	assert := newAsserter(t)
+	tmpdir := t.TempDir()
+
+	files := []string{
+		"build/x", "src/build/y", "src/a.log", "src/b.log", "src/keep.log",
+		"tmp", "src/tmp/z", "docs/c.tmp", "docs/a/b/c.tmp", "docs/d.txt",
+	}
+	for _, nm := range files {
+		err := mkfile(tmpdir, nm)
+		assert(err == nil, "mkfile: %s", err)
+	}
+
+	ign := "# nested rules override the parent\nbuild/y\n!a.log\n"
+	err := os.WriteFile(filepath.Join(tmpdir, "src/.fioignore"), []byte(ign), 0600)
+	assert(err == nil, "write: %s", err)
+
+	tests := []struct {
+		files []string
+		want  []string
+	}{
+		{nil, []string{"docs/d.txt", "src/.fioignore", "src/build/y", "src/keep.log", "tmp"}},
+		{[]string{".fioignore"}, []string{"docs/d.txt", "src/.fioignore", "src/a.log", "src/keep.log", "tmp"}},
+	}
+
+	for _, tx := range tests {
+		for _, sorted := range []bool{false, true} {
+			opt := Options{
+				Type:        FILE,
+				Sorted:      sorted,
+				Ignore:      []string{"/build/", "*.log", "!keep.log", "tmp/", "docs/**/*.tmp"},
+				IgnoreFiles: tx.files,
+			}
+
+			var got []string
+			for fi, err := range All(context.Background(), []string{tmpdir}, opt) {
+				assert(err == nil, "walk: %s", err)
+				got = append(got, fi.RelPath())
+			}
+
+			if !sorted {
+				slices.Sort(got)
+			}
+			assert(slices.Equal(got, tx.want), "ignore files %v: exp %v, saw %v", tx.files, tx.want, got)
+		}
+	}
+
+	// a bad pattern doesn't void the valid ones
+	opt := Options{
+		Type:   FILE,
+		Ignore: []string{"a/[b", "*.log"},
+	}
+	var nerr int
+	for fi, err := range All(context.Background(), []string{tmpdir}, opt) {
+		if err != nil {
+			nerr++
+			continue
+		}
+		assert(!strings.HasSuffix(fi.Name(), ".log"), "walk: saw ignored %s", fi.RelPath())
+	}
+	assert(nerr > 0, "walk: expected bad pattern error")
+
+	// dir-only rules match followed symlinks to dirs
+	ext := t.TempDir()
+	err = mkfile(ext, "o")
+	assert(err == nil, "mkfile: %s", err)
+	err = os.Symlink(ext, filepath.Join(tmpdir, "docs/out"))
+	assert(err == nil, "symlink: %s", err)
+
+	for _, rules := range [][]string{nil, {"out/"}} {
+		opt := Options{
+			Type:           FILE,
+			FollowSymlinks: true,
+			Ignore:         rules,
+		}
+
+		var seen bool
+		for fi, err := range All(context.Background(), []string{tmpdir}, opt) {
+			assert(err == nil, "walk: %s", err)
+			seen = seen || fi.RelPath() == "docs/out/o"
+		}
+		assert(seen == (rules == nil), "ignore %v: saw docs/out/o %v", rules, seen)
+	}
+}
+
 func compareWalks(tx *test, t *testing.T) {
 	assert := newAsserter(t)
 
@@ -36,27 +36,143 @@
 //  Wait() harvests the errors and closes all the worker goroutines.
 //  Thus, the pool cannot be used to submit new work after Wait()
 //  is called.
+//
+//  Work submitted via SubmitKeyed() is serialized per key: all the work
+//  with the same key is processed in order by one worker.
+//
+//  Stats() returns a live snapshot of the pool's activity and
+//  WithWorkPoolHook() reports each unit of work to a caller provided
+//  hook.
+//
+//  With the WithAdaptive() option, the number of active workers adapts
+//  to the observed throughput of the pool.
+//
+//  A worker that panics doesn't take down the pool: the panic is
+//  returned by Wait() as a PanicError and the worker continues with
+//  the next unit of work.
+//
+//  A pool created via NewWorkPoolContext() stops processing work when
+//  its context is cancelled; the work that is already queued is
+//  discarded. With the WithFailFast() option, the first error returned
+//  by a worker cancels the pool.
 
 package fio
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/maphash"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type WorkPool[Work any] struct {
+	// smu serializes the start of a submission with Close(); stopped
+	// is only set while holding it for writing. Close() waits for the
+	// submissions in flight via senders; quit wakes the ones that are
+	// blocked on a full queue.
+	smu     sync.RWMutex
 	stopped atomic.Bool
+	senders sync.WaitGroup
+	quit    chan struct{}
 	wg      sync.WaitGroup
 	ch      chan Work
 
+	// set if the pool refused or discarded work after it was cancelled
+	dropped atomic.Bool
+
+	// per-worker queues for keyed work
+	kch  []chan Work
+	seed maphash.Seed
+
+	// workers [0, active) process the shared queue; the others are
+	// parked until wake is closed.
+	active atomic.Int64
+	mu     sync.Mutex
+	wake   chan struct{}
+
+	// closed when all the workers are done
+	done chan struct{}
+
+	// parent is the caller's context; ctx is derived from it and
+	// is cancelled on the first error in fail-fast mode.
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	failFast bool
+
+	name  string
+	hook  WorkPoolHook
+	stats poolStats
+
 	ech  chan error
 	ewg  sync.WaitGroup
 	errs []error
 }
 
+// WorkPoolOption captures the options for creating a WorkPool
+type WorkPoolOption func(o *workPoolOpt)
+
+// WithFailFast cancels the pool on the first error returned by a
+// worker; the remaining work is discarded and Submit() fails.
+func WithFailFast(ff bool) WorkPoolOption {
+	return func(o *workPoolOpt) {
+		o.failFast = ff
+	}
+}
+
+// WithExactSize makes the pool use exactly the number of workers it
+// is created with; so a pool of 1 worker is serial. Without it, a pool
+// of 1 (or fewer) workers uses all available cpus.
+func WithExactSize(exact bool) WorkPoolOption {
+	return func(o *workPoolOpt) {
+		o.exact = exact
+	}
+}
+
+type workPoolOpt struct {
+	failFast bool
+	ordered  bool
+	exact    bool
+
+	name string
+	hook WorkPoolHook
+
+	// min workers for an adaptive pool
+	adaptive int
+}
+
+// PanicError is returned by Wait() for every worker invocation that
+// panicked; the worker recovers and continues to process the
+// remaining work.
+type PanicError struct {
+	// Value is the value passed to panic()
+	Value any
+
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+// Error returns a string representation of PanicError
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("workpool: panic: %v\n%s", e.Value, e.Stack)
+}
+
+// Unwrap returns the panic value if it is an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+var _ error = &PanicError{}
+
 // Error returned if new work is submitted after Wait() or if Wait() is called
 // multiple times.
 var ErrCompleted = errors.New("workpool: workpool closed")
@@ -66,36 +182,114 @@ var ErrNotClosed = errors.New("workpool: workpool not closed before waiting")
 
 // NewWorkPool creates a worker pool that invokes caller provided worker 'fp'.
 // Each worker will process one unit of "work" submitted via Submit().
-func NewWorkPool[Work any](nworkers int, fp func(i int, w Work) error) *WorkPool[Work] {
-	if nworkers <= 1 {
-		nworkers = runtime.NumCPU()
+// A pool of one (or fewer) workers uses all available cpus; see
+// WithExactSize().
+func NewWorkPool[Work any](nworkers int, fp func(i int, w Work) error, opt ...WorkPoolOption) *WorkPool[Work] {
+	return NewWorkPoolContext(context.Background(), nworkers, func(_ context.Context, i int, w Work) error {
+		return fp(i, w)
+	}, opt...)
+}
+
+// NewWorkPoolContext is like NewWorkPool - except the pool is cancelled
+// when 'ctx' is done. Each invocation of the worker 'fp' gets a context
+// that is cancelled when the pool is cancelled; long running workers
+// should use it to abandon their work.
+func NewWorkPoolContext[Work any](ctx context.Context, nworkers int, fp func(ctx context.Context, i int, w Work) error, opt ...WorkPoolOption) *WorkPool[Work] {
+	var o workPoolOpt
+	for _, fn := range opt {
+		fn(&o)
+	}
+
+	if o.hook == nil {
+		o.hook = nopHook{}
 	}
 
+	nworkers = o.poolSize(nworkers)
+
 	wp := &WorkPool[Work]{
-		ch:   make(chan Work, nworkers),
-		ech:  make(chan error, 1),
-		errs: make([]error, 0, 1),
+		ch:       make(chan Work, nworkers),
+		kch:      make([]chan Work, nworkers),
+		seed:     maphash.MakeSeed(),
+		wake:     make(chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		parent:   ctx,
+		failFast: o.failFast,
+		name:     o.name,
+		hook:     o.hook,
+		ech:      make(chan error, 1),
+		errs:     make([]error, 0, 1),
+	}
+
+	wp.stats.busy = make([]atomic.Int64, nworkers)
+	wp.active.Store(int64(nworkers))
+	if o.adaptive > 0 {
+		wp.active.Store(int64(min(o.adaptive, nworkers)))
+		go wp.adapt(min(o.adaptive, nworkers))
 	}
 
+	wp.ctx, wp.cancel = context.WithCancel(ctx)
 	wp.stopped.Store(false)
 	wp.wg.Add(nworkers)
 	for i := 0; i < nworkers; i++ {
-		go func(wp *WorkPool[Work], i int, fp func(i int, w Work) error) {
-			defer func() {
-				if e := recover(); e != nil {
-					if err := e.(error); err != nil {
-						wp.ech <- fmt.Errorf("workpool: panic: %w", err)
+		wp.kch[i] = make(chan Work, 1)
+		go func(wp *WorkPool[Work], i int, fp func(ctx context.Context, i int, w Work) error) {
+			defer wp.wg.Done()
+
+			ch, kch := wp.ch, wp.kch[i]
+			for ch != nil || kch != nil {
+				var w Work
+				var ok bool
+
+				// a parked worker only serves its keyed queue; the
+				// active workers drain the shared queue after Close().
+				qch, wake := ch, wp.gate(i)
+				if wake != nil {
+					if kch == nil {
+						break
 					}
+					qch = nil
 				}
-			}()
 
-			for w := range wp.ch {
-				err := fp(i, w)
+				select {
+				case w, ok = <-qch:
+					if !ok {
+						ch = nil
+						continue
+					}
+				case w, ok = <-kch:
+					if !ok {
+						kch = nil
+						continue
+					}
+				case <-wake:
+					continue
+				}
+
+				wp.stats.queued.Add(-1)
+
+				// drain the queue of a cancelled pool
+				if wp.ctx.Err() != nil {
+					wp.dropped.Store(true)
+					wp.stats.discarded.Add(1)
+					wp.hook.Discarded(wp.name)
+					continue
+				}
+
+				wp.stats.inflight.Add(1)
+				wp.hook.Started(wp.name, i)
+
+				t0 := time.Now()
+				err := wp.call(fp, i, w)
+				elapsed := time.Since(t0)
+
+				wp.stats.inflight.Add(-1)
+				wp.stats.done(i, elapsed, err)
+				wp.hook.Finished(wp.name, i, elapsed, err)
 				if err != nil {
-					wp.ech <- err
+					wp.fail(err)
 				}
 			}
-			wp.wg.Done()
 		}(wp, i, fp)
 	}
 
@@ -111,15 +305,34 @@ func NewWorkPool[Work any](nworkers int, fp func(i int, w Work) error) *WorkPool
 	return wp
 }
 
+// poolSize returns the number of workers in a pool created for
+// 'nworkers' workers
+func (o *workPoolOpt) poolSize(nworkers int) int {
+	if nworkers <= 0 || (nworkers == 1 && !o.exact) {
+		return runtime.NumCPU()
+	}
+	return nworkers
+}
+
 // Wait closes the work channel and waits for all workers
-// to end. Returns any errors from the workers.
+// to end. Returns any errors from the workers. If the pool's
+// context was cancelled and that caused work to be refused,
+// discarded or to fail, the context's error is returned as well.
 // It is an error to call this multiple times
 func (wp *WorkPool[Work]) Wait() error {
 	wp.wg.Wait()
+	close(wp.done)
 	close(wp.ech)
 
 	// wait for error harvestor to complete
 	wp.ewg.Wait()
+	wp.cancel()
+
+	// a pool that did all its work before it was cancelled is fine
+	if err := wp.parent.Err(); err != nil && (wp.dropped.Load() || len(wp.errs) > 0) {
+		wp.errs = append(wp.errs, err)
+	}
+
 	if len(wp.errs) > 0 {
 		return errors.Join(wp.errs...)
 	}
@@ -127,27 +340,127 @@ func (wp *WorkPool[Work]) Wait() error {
 }
 
 // Close the work submission to workers and signal
-// to them that there's no more work forthcoming.
+// to them that there's no more work forthcoming. Concurrent calls to
+// Submit() that are blocked on a full queue and the ones that follow
+// fail with ErrCompleted.
 func (wp *WorkPool[Work]) Close() {
+	wp.smu.Lock()
 	if wp.stopped.Swap(true) {
+		wp.smu.Unlock()
 		panic("worker already closed")
 	}
+	close(wp.quit)
+	wp.smu.Unlock()
+
+	// no new submissions can start; wait for the ones in flight
+	wp.senders.Wait()
 	close(wp.ch)
+	for _, ch := range wp.kch {
+		close(ch)
+	}
+}
+
+// Submit submits one unit of work to the worker. It returns
+// ErrCompleted if the pool is closed and the context error if the
+// pool is cancelled.
+func (wp *WorkPool[Work]) Submit(w Work) error {
+	return wp.submit(wp.ch, w)
+}
+
+// SubmitKeyed submits one unit of work that is serialized with all
+// other work submitted with the same key: such work is processed in
+// the order of submission by a single worker. Work with different
+// keys (and work submitted via Submit()) is processed concurrently.
+// It returns the same errors as Submit().
+func (wp *WorkPool[Work]) SubmitKeyed(key string, w Work) error {
+	i := maphash.String(wp.seed, key) % uint64(len(wp.kch))
+	return wp.submit(wp.kch[i], w)
 }
 
-// Submit submits one unit of work to the worker
-// WorkPool must be active.
-func (wp *WorkPool[Work]) Submit(w Work) {
+// queue 'w' on 'ch' unless the pool is closed or cancelled
+func (wp *WorkPool[Work]) submit(ch chan Work, w Work) error {
+	wp.smu.RLock()
 	if wp.stopped.Load() {
-		panic("worker stopped")
+		wp.smu.RUnlock()
+		return ErrCompleted
+	}
+
+	// we don't hold the lock while we block on a full queue; so the
+	// workers can submit work or errors while Close() is pending.
+	wp.senders.Add(1)
+	wp.smu.RUnlock()
+	defer wp.senders.Done()
+
+	if err := wp.ctx.Err(); err != nil {
+		wp.dropped.Store(true)
+		return err
+	}
+
+	// count it before a worker can dequeue it
+	wp.stats.queued.Add(1)
+	select {
+	case ch <- w:
+		wp.hook.Queued(wp.name)
+		return nil
+	case <-wp.quit:
+		wp.stats.queued.Add(-1)
+		return ErrCompleted
+	case <-wp.ctx.Done():
+		wp.stats.queued.Add(-1)
+		wp.dropped.Store(true)
+		return wp.ctx.Err()
+	}
+}
+
+// trySubmit queues 'w' on the shared queue only if it won't block;
+// it returns false if the queue is full or the pool can't accept work.
+func (wp *WorkPool[Work]) trySubmit(w Work) (bool, error) {
+	wp.smu.RLock()
+	defer wp.smu.RUnlock()
+
+	if wp.stopped.Load() {
+		return false, ErrCompleted
+	}
+
+	if err := wp.ctx.Err(); err != nil {
+		wp.dropped.Store(true)
+		return false, err
+	}
+
+	wp.stats.queued.Add(1)
+	select {
+	case wp.ch <- w:
+		wp.hook.Queued(wp.name)
+		return true, nil
+	default:
+		wp.stats.queued.Add(-1)
+		return false, nil
 	}
-	wp.ch <- w
 }
 
 // Submit an error to the pool - if the user provided
 // worker does things asynchronously.
 func (wp *WorkPool[Work]) Err(err error) {
 	if !wp.stopped.Load() {
-		wp.ech <- err
+		wp.fail(err)
+	}
+}
+
+// call the worker 'fp' and convert its panic into an error
+func (wp *WorkPool[Work]) call(fp func(ctx context.Context, i int, w Work) error, i int, w Work) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = &PanicError{e, debug.Stack()}
+		}
+	}()
+
+	return fp(wp.ctx, i, w)
+}
+
+// record an error and cancel the pool if we're failing fast
+func (wp *WorkPool[Work]) fail(err error) {
+	wp.ech <- err
+	if wp.failFast {
+		wp.cancel()
 	}
 }
@@ -0,0 +1,149 @@
+// workpool_adapt.go - adaptive concurrency for worker pools
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"time"
+)
+
+// interval at which an adaptive pool measures its throughput
+const _adaptInterval = 100 * time.Millisecond
+
+// WithAdaptive makes the pool adapt the number of active workers to
+// the observed throughput: the pool starts with 'nmin' workers and
+// grows or shrinks - one worker at a time - between 'nmin' and the
+// number of workers it was created with. A pool grows only while it
+// has queued work; it shrinks when adding workers lowers the
+// throughput or inflates the latency of the work, eg on spinning disks
+// or network file systems. Keyed work (SubmitKeyed()) is processed by
+// its worker regardless of whether the worker is active.
+func WithAdaptive(nmin int) WorkPoolOption {
+	return func(o *workPoolOpt) {
+		o.adaptive = max(nmin, 1)
+	}
+}
+
+// gate returns nil if worker 'i' is active; otherwise it returns a
+// chan that is closed when the number of active workers changes.
+func (wp *WorkPool[Work]) gate(i int) chan struct{} {
+	if int64(i) < wp.active.Load() {
+		return nil
+	}
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if int64(i) < wp.active.Load() {
+		return nil
+	}
+	return wp.wake
+}
+
+// set the number of active workers and wake up the parked workers
+func (wp *WorkPool[Work]) setActive(n int) {
+	wp.mu.Lock()
+	wp.active.Store(int64(n))
+	close(wp.wake)
+	wp.wake = make(chan struct{})
+	wp.mu.Unlock()
+}
+
+// adapt the number of active workers until the pool is done
+func (wp *WorkPool[Work]) adapt(nmin int) {
+	a := &adaptor{
+		min: nmin,
+		max: len(wp.kch),
+		dir: 1,
+	}
+
+	tick := time.NewTicker(_adaptInterval)
+	defer tick.Stop()
+
+	var work int64
+	var busy time.Duration
+	for {
+		select {
+		case <-wp.done:
+			return
+		case <-tick.C:
+		}
+
+		st := wp.Stats()
+		w := st.Completed + st.Failed
+		b := sum(st.Busy)
+
+		n, dt := w-work, b-busy
+		work, busy = w, b
+
+		// we learn nothing while the workers are stuck
+		if n == 0 {
+			continue
+		}
+
+		m := int(wp.active.Load())
+		if k := a.adjust(m, n, dt/time.Duration(n), st.Queued > 0); k != m {
+			wp.setActive(k)
+		}
+	}
+}
+
+// adaptor hill-climbs to the number of workers with the best
+// throughput
+type adaptor struct {
+	min, max int
+
+	// direction of the last change: +1 or -1
+	dir int
+
+	// throughput and mean latency seen in the last interval
+	rate int64
+	lat  time.Duration
+}
+
+// adjust returns the new number of workers given the current number 'n',
+// the work completed in the last interval and its mean latency.
+func (a *adaptor) adjust(n int, rate int64, lat time.Duration, backlog bool) int {
+	switch {
+	case a.rate == 0:
+		// first measurement
+
+	case rate*20 < a.rate*19 || lat > a.lat*3/2:
+		// the last change hurt; undo it
+		a.dir = -a.dir
+
+	case rate*20 <= a.rate*21 && a.dir > 0:
+		// growing didn't help; probe the other way
+		a.dir = -1
+	}
+	a.rate, a.lat = rate, lat
+
+	// more workers can't help if they have nothing to do
+	if a.dir > 0 && !backlog {
+		return n
+	}
+
+	k := n + a.dir
+	if k < a.min || k > a.max {
+		a.dir = -a.dir
+		return n
+	}
+	return k
+}
+
+func sum[T ~int64](v []T) T {
+	var s T
+	for _, x := range v {
+		s += x
+	}
+	return s
+}
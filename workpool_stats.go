@@ -0,0 +1,168 @@
+// workpool_stats.go - instrumentation for worker pools
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WorkPoolLatency are the upper bounds of the buckets of the latency
+// histogram in WorkPoolStats; the last bucket of the histogram counts
+// the work that took longer than the largest bound.
+var WorkPoolLatency = [...]time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// WorkPoolStats is a snapshot of the activity of a WorkPool
+type WorkPoolStats struct {
+	// Workers is the number of active workers
+	Workers int64
+
+	// Queued is the number of units of work waiting for a worker
+	Queued int64
+
+	// InFlight is the number of units of work being processed
+	InFlight int64
+
+	// Completed and Failed count the units of work whose worker
+	// returned nil and an error respectively.
+	Completed int64
+	Failed    int64
+
+	// Discarded counts the queued work dropped by a cancelled pool
+	Discarded int64
+
+	// Latency is a histogram of the time taken by the worker for each
+	// unit of work; Latency[i] counts the work that took at most
+	// WorkPoolLatency[i].
+	Latency [len(WorkPoolLatency) + 1]int64
+
+	// Busy is the total time each worker spent processing work
+	Busy []time.Duration
+}
+
+// String returns a string representation of the stats
+func (s *WorkPoolStats) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d workers, %d queued, %d in-flight, %d completed, %d failed, %d discarded; latency",
+		s.Workers, s.Queued, s.InFlight, s.Completed, s.Failed, s.Discarded)
+	for i, n := range s.Latency {
+		if i < len(WorkPoolLatency) {
+			fmt.Fprintf(&b, " <=%s:%d", WorkPoolLatency[i], n)
+		} else {
+			fmt.Fprintf(&b, " >%s:%d", WorkPoolLatency[i-1], n)
+		}
+	}
+	fmt.Fprintf(&b, "; busy %v", s.Busy)
+	return b.String()
+}
+
+// WorkPoolHook is notified of the progress of each unit of work in a
+// WorkPool; eg to export metrics. 'pool' is the name of the pool set
+// via WithWorkPoolHook(). The methods are called concurrently from the
+// submitters and workers of the pool; they must be fast and safe for
+// concurrent use.
+type WorkPoolHook interface {
+	// Queued is called after a unit of work is submitted
+	Queued(pool string)
+
+	// Started is called when worker 'i' starts a unit of work
+	Started(pool string, i int)
+
+	// Finished is called when worker 'i' finishes a unit of work
+	// after 'elapsed' time; 'err' is the error from the worker.
+	Finished(pool string, i int, elapsed time.Duration, err error)
+
+	// Discarded is called when a cancelled pool drops queued work
+	Discarded(pool string)
+}
+
+// WithWorkPoolHook reports the progress of the pool to 'h' using the
+// name 'pool'.
+func WithWorkPoolHook(pool string, h WorkPoolHook) WorkPoolOption {
+	return func(o *workPoolOpt) {
+		o.name = pool
+		o.hook = h
+	}
+}
+
+// live counters of a WorkPool
+type poolStats struct {
+	queued    atomic.Int64
+	inflight  atomic.Int64
+	completed atomic.Int64
+	failed    atomic.Int64
+	discarded atomic.Int64
+
+	latency [len(WorkPoolLatency) + 1]atomic.Int64
+	busy    []atomic.Int64
+}
+
+// account for one unit of work processed by worker 'i'
+func (s *poolStats) done(i int, elapsed time.Duration, err error) {
+	if err != nil {
+		s.failed.Add(1)
+	} else {
+		s.completed.Add(1)
+	}
+
+	j := 0
+	for j < len(WorkPoolLatency) && elapsed > WorkPoolLatency[j] {
+		j++
+	}
+	s.latency[j].Add(1)
+	s.busy[i].Add(int64(elapsed))
+}
+
+// Stats returns a snapshot of the pool's activity; it is safe to call
+// concurrently with the workers.
+func (wp *WorkPool[Work]) Stats() WorkPoolStats {
+	s := &wp.stats
+	st := WorkPoolStats{
+		Workers:   wp.active.Load(),
+		Queued:    s.queued.Load(),
+		InFlight:  s.inflight.Load(),
+		Completed: s.completed.Load(),
+		Failed:    s.failed.Load(),
+		Discarded: s.discarded.Load(),
+		Busy:      make([]time.Duration, len(s.busy)),
+	}
+
+	for i := range s.latency {
+		st.Latency[i] = s.latency[i].Load()
+	}
+	for i := range s.busy {
+		st.Busy[i] = time.Duration(s.busy[i].Load())
+	}
+	return st
+}
+
+type nopHook struct{}
+
+func (nopHook) Queued(_ string)                                    {}
+func (nopHook) Started(_ string, _ int)                            {}
+func (nopHook) Finished(_ string, _ int, _ time.Duration, _ error) {}
+func (nopHook) Discarded(_ string)                                 {}
+
+var _ WorkPoolHook = nopHook{}
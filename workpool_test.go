@@ -0,0 +1,580 @@
+// workpool_test.go - tests for the worker pool
+//
+// (c) 2024 Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package fio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkPool(t *testing.T) {
+	assert := newAsserter(t)
+
+	var sum atomic.Int64
+	wp := NewWorkPool[int](4, func(_ int, w int) error {
+		sum.Add(int64(w))
+		return nil
+	})
+
+	for i := 1; i <= 100; i++ {
+		err := wp.Submit(i)
+		assert(err == nil, "submit %d: %s", i, err)
+	}
+	wp.Close()
+
+	err := wp.Wait()
+	assert(err == nil, "wait: %s", err)
+	assert(sum.Load() == 5050, "exp sum 5050, saw %d", sum.Load())
+
+	err = wp.Submit(1)
+	assert(errors.Is(err, ErrCompleted), "submit: exp ErrCompleted, saw %v", err)
+}
+
+func TestWorkPoolSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	// the max worker index seen by a pool of 1 worker
+	maxWorker := func(opt ...WorkPoolOption) int {
+		var mu sync.Mutex
+		var n int
+		wp := NewWorkPool[int](1, func(i int, _ int) error {
+			mu.Lock()
+			n = max(n, i)
+			mu.Unlock()
+			return nil
+		}, opt...)
+
+		for i := 0; i < 100; i++ {
+			err := wp.SubmitKeyed(fmt.Sprintf("%d", i), i)
+			assert(err == nil, "submit %d: %s", i, err)
+		}
+		wp.Close()
+		err := wp.Wait()
+		assert(err == nil, "wait: %s", err)
+		return n
+	}
+
+	n := maxWorker()
+	assert(n < runtime.NumCPU(), "default: worker %d out of range", n)
+	if runtime.NumCPU() > 1 {
+		assert(n > 0, "default: exp %d workers, saw 1", runtime.NumCPU())
+	}
+
+	n = maxWorker(WithExactSize(true))
+	assert(n == 0, "exact: exp 1 worker, saw worker %d", n)
+}
+
+func TestWorkPoolFailFast(t *testing.T) {
+	assert := newAsserter(t)
+
+	errBad := errors.New("bad work")
+
+	var n atomic.Int64
+	wp := NewWorkPoolContext[int](context.Background(), 4, func(ctx context.Context, _ int, w int) error {
+		n.Add(1)
+		if w == 10 {
+			return errBad
+		}
+		return nil
+	}, WithFailFast(true))
+
+	var err error
+	for i := 0; i < 100000 && err == nil; i++ {
+		err = wp.Submit(i)
+	}
+	assert(errors.Is(err, context.Canceled), "submit: exp cancel, saw %v", err)
+	wp.Close()
+
+	err = wp.Wait()
+	assert(errors.Is(err, errBad), "wait: exp %s, saw %v", errBad, err)
+	assert(n.Load() < 100000, "exp work to be discarded; saw %d", n.Load())
+}
+
+func TestWorkPoolCancel(t *testing.T) {
+	assert := newAsserter(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan bool)
+	wp := NewWorkPoolContext[int](ctx, 2, func(ctx context.Context, _ int, w int) error {
+		if w == 0 {
+			close(started)
+		}
+		<-ctx.Done()
+		return nil
+	})
+
+	err := wp.Submit(0)
+	assert(err == nil, "submit: %s", err)
+
+	<-started
+	cancel()
+
+	err = wp.Submit(1)
+	assert(errors.Is(err, context.Canceled), "submit: exp cancel, saw %v", err)
+	wp.Close()
+
+	err = wp.Wait()
+	assert(errors.Is(err, context.Canceled), "wait: exp cancel, saw %v", err)
+
+	// cancelling a pool after all its work is done isn't an error
+	var done sync.WaitGroup
+	ctx, cancel = context.WithCancel(context.Background())
+	wp = NewWorkPoolContext[int](ctx, 2, func(ctx context.Context, _ int, w int) error {
+		done.Done()
+		return nil
+	})
+
+	done.Add(10)
+	for i := 0; i < 10; i++ {
+		err = wp.Submit(i)
+		assert(err == nil, "submit: %s", err)
+	}
+	done.Wait()
+	wp.Close()
+	cancel()
+
+	err = wp.Wait()
+	assert(err == nil, "wait: exp no error, saw %v", err)
+}
+
+func TestWorkPoolCloseRace(t *testing.T) {
+	assert := newAsserter(t)
+
+	for i := 0; i < 100; i++ {
+		wp := NewWorkPool[int](2, func(_ int, w int) error {
+			return nil
+		})
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for wp.Submit(j) == nil {
+				}
+			}()
+		}
+
+		// concurrent submits must fail cleanly after Close()
+		wp.Close()
+		wg.Wait()
+
+		err := wp.Submit(0)
+		assert(errors.Is(err, ErrCompleted), "submit: exp ErrCompleted, saw %v", err)
+
+		err = wp.Wait()
+		assert(err == nil, "wait: %s", err)
+	}
+}
+
+// workers that call Err() or Submit() while Close() is pending
+func TestWorkPoolCloseWorkers(t *testing.T) {
+	assert := newAsserter(t)
+
+	errBad := errors.New("bad work")
+	for i := 0; i < 20; i++ {
+		var wp *WorkPool[int]
+		wp = NewWorkPool[int](2, func(_ int, w int) error {
+			time.Sleep(100 * time.Microsecond)
+			wp.Err(errBad)
+			if w%7 == 0 {
+				wp.Submit(w + 1)
+			}
+			return nil
+		}, WithExactSize(true))
+
+		done := make(chan error)
+		go func() {
+			for j := 1; wp.Submit(j) == nil; j++ {
+			}
+			done <- nil
+		}()
+
+		time.Sleep(time.Millisecond)
+		go func() {
+			wp.Close()
+			done <- wp.Wait()
+		}()
+
+		for range 2 {
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				assert(false, "%d: pool deadlocked in Close", i)
+			}
+		}
+	}
+}
+
+func TestWorkPoolPanic(t *testing.T) {
+	assert := newAsserter(t)
+
+	errBad := errors.New("bad work")
+
+	var n atomic.Int64
+	wp := NewWorkPool[int](2, func(_ int, w int) error {
+		switch w {
+		case 3:
+			panic("not an error")
+		case 7:
+			panic(errBad)
+		}
+		n.Add(1)
+		return nil
+	})
+
+	for i := 0; i < 100; i++ {
+		err := wp.Submit(i)
+		assert(err == nil, "submit %d: %s", i, err)
+	}
+	wp.Close()
+
+	err := wp.Wait()
+	assert(err != nil, "wait: exp panic errors")
+	assert(errors.Is(err, errBad), "wait: exp %s, saw %v", errBad, err)
+	assert(n.Load() == 98, "exp 98 completed, saw %d", n.Load())
+
+	var pe *PanicError
+	assert(errors.As(err, &pe), "wait: exp PanicError, saw %T", err)
+	assert(len(pe.Stack) > 0, "panic: exp stack trace")
+	assert(strings.Contains(err.Error(), "not an error"), "wait: missing panic value: %s", err)
+}
+
+func TestWorkPoolKeyed(t *testing.T) {
+	assert := newAsserter(t)
+
+	type keyed struct {
+		key string
+		seq int
+	}
+
+	const nkeys = 8
+
+	var mu sync.Mutex
+	var busy [nkeys]atomic.Int32
+	seen := make(map[string][]int)
+
+	wp := NewWorkPool[keyed](4, func(_ int, w keyed) error {
+		k := int(w.key[0] - 'a')
+		if busy[k].Add(1) != 1 {
+			return fmt.Errorf("key %s: concurrent work", w.key)
+		}
+		time.Sleep(10 * time.Microsecond)
+
+		mu.Lock()
+		seen[w.key] = append(seen[w.key], w.seq)
+		mu.Unlock()
+
+		busy[k].Add(-1)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for k := range nkeys {
+		wg.Add(1)
+		go func(key string) {
+			for i := range 100 {
+				err := wp.SubmitKeyed(key, keyed{key, i})
+				assert(err == nil, "submit %s: %s", key, err)
+			}
+			wg.Done()
+		}(string(rune('a' + k)))
+	}
+	wg.Wait()
+	wp.Close()
+
+	err := wp.Wait()
+	assert(err == nil, "wait: %s", err)
+	assert(len(seen) == nkeys, "exp %d keys, saw %d", nkeys, len(seen))
+	for k, v := range seen {
+		assert(slices.IsSorted(v) && len(v) == 100, "key %s: out of order: %v", k, v)
+	}
+}
+
+func TestWorkPoolStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	errBad := errors.New("bad work")
+
+	h := &countHook{}
+	release := make(chan bool)
+	wp := NewWorkPool[int](2, func(_ int, w int) error {
+		<-release
+		if w%10 == 0 {
+			return errBad
+		}
+		return nil
+	}, WithWorkPoolHook("test", h))
+
+	go func() {
+		for i := range 100 {
+			wp.Submit(i)
+		}
+		wp.Close()
+	}()
+
+	// both workers are blocked until we release them
+	for wp.Stats().InFlight != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	err := wp.Wait()
+	assert(errors.Is(err, errBad), "wait: exp %s, saw %v", errBad, err)
+
+	st := wp.Stats()
+	assert(st.Queued == 0 && st.InFlight == 0, "exp idle pool: %s", &st)
+	assert(st.Completed == 90 && st.Failed == 10, "exp 90 completed, 10 failed: %s", &st)
+	assert(len(st.Busy) == 2, "exp 2 workers, saw %d", len(st.Busy))
+
+	var n int64
+	for _, v := range st.Latency {
+		n += v
+	}
+	assert(n == 100, "exp 100 in latency histogram, saw %d", n)
+
+	assert(h.queued.Load() == 100, "hook: exp 100 queued, saw %d", h.queued.Load())
+	assert(h.started.Load() == 100, "hook: exp 100 started, saw %d", h.started.Load())
+	assert(h.failed.Load() == 10, "hook: exp 10 failed, saw %d", h.failed.Load())
+}
+
+// hook that counts the work
+type countHook struct {
+	queued  atomic.Int64
+	started atomic.Int64
+	failed  atomic.Int64
+}
+
+func (h *countHook) Queued(_ string)         { h.queued.Add(1) }
+func (h *countHook) Started(_ string, _ int) { h.started.Add(1) }
+func (h *countHook) Discarded(_ string)      {}
+func (h *countHook) Finished(_ string, _ int, _ time.Duration, err error) {
+	if err != nil {
+		h.failed.Add(1)
+	}
+}
+
+func TestWorkPoolAdaptive(t *testing.T) {
+	assert := newAsserter(t)
+
+	// the work is latency bound; so more workers help
+	var peak atomic.Int64
+	wp := NewWorkPool[int](16, func(_ int, w int) error {
+		time.Sleep(2 * time.Millisecond)
+		return nil
+	}, WithAdaptive(1))
+
+	st := wp.Stats()
+	assert(st.Workers == 1, "exp 1 worker, saw %d", st.Workers)
+
+	go func() {
+		for i := range 4000 {
+			wp.Submit(i)
+			if n := wp.Stats().Workers; n > peak.Load() {
+				peak.Store(n)
+			}
+		}
+		wp.Close()
+	}()
+
+	err := wp.Wait()
+	assert(err == nil, "wait: %s", err)
+	assert(peak.Load() > 1, "exp the pool to grow, saw %d workers", peak.Load())
+	assert(peak.Load() <= 16, "exp at most 16 workers, saw %d", peak.Load())
+}
+
+func TestAdaptor(t *testing.T) {
+	assert := newAsserter(t)
+
+	a := &adaptor{min: 1, max: 4, dir: 1}
+
+	// grow while the throughput improves
+	n := a.adjust(1, 100, time.Millisecond, true)
+	assert(n == 2, "exp 2, saw %d", n)
+	n = a.adjust(n, 200, time.Millisecond, true)
+	assert(n == 3, "exp 3, saw %d", n)
+
+	// don't grow without a backlog
+	n = a.adjust(n, 300, time.Millisecond, false)
+	assert(n == 3, "exp 3, saw %d", n)
+
+	// stay within bounds
+	n = a.adjust(n, 400, time.Millisecond, true)
+	assert(n == 4, "exp 4, saw %d", n)
+	n = a.adjust(n, 500, time.Millisecond, true)
+	assert(n == 4, "exp 4, saw %d", n)
+
+	// shrink when the last change hurt
+	a = &adaptor{min: 1, max: 8, dir: 1}
+	n = a.adjust(4, 400, time.Millisecond, true)
+	assert(n == 5, "exp 5, saw %d", n)
+	n = a.adjust(n, 300, time.Millisecond, true)
+	assert(n == 4, "exp 4, saw %d", n)
+
+	// shrink when the latency balloons
+	a = &adaptor{min: 1, max: 8, dir: 1}
+	n = a.adjust(4, 400, time.Millisecond, true)
+	n = a.adjust(n, 420, 10*time.Millisecond, true)
+	assert(n == 4, "exp 4, saw %d", n)
+}
+
+func TestPipeline(t *testing.T) {
+	assert := newAsserter(t)
+
+	square := func(_ context.Context, v int) (int, error) {
+		// make the later inputs finish first
+		time.Sleep(time.Duration(100-v) * 10 * time.Microsecond)
+		return v * v, nil
+	}
+
+	var i int
+	for v, err := range Pipeline(context.Background(), 8, seqN(100), square, WithOrdered(true)) {
+		assert(err == nil, "%d: %s", i, err)
+		assert(v == i*i, "%d: exp %d, saw %d", i, i*i, v)
+		i++
+	}
+	assert(i == 100, "exp 100 results, saw %d", i)
+
+	sum, err := Reduce(context.Background(), 8, seqN(100), square, 0, func(a, v int) int {
+		return a + v
+	})
+	assert(err == nil, "reduce: %s", err)
+	assert(sum == 328350, "exp sum 328350, saw %d", sum)
+
+	// stopping early must not leak workers
+	var running atomic.Int64
+	busy := func(ctx context.Context, v int) (int, error) {
+		running.Add(1)
+		defer running.Add(-1)
+		return square(ctx, v%100)
+	}
+	for v, err := range Pipeline(context.Background(), 4, seqN(100000), busy) {
+		assert(err == nil, "%s", err)
+		if v > 0 {
+			break
+		}
+	}
+	assert(running.Load() == 0, "exp no running workers, saw %d", running.Load())
+
+	// a slow input holds back the inputs after it
+	var started, seen atomic.Int64
+	slow := func(_ context.Context, v int) (int, error) {
+		started.Add(1)
+		if v == 0 {
+			time.Sleep(50 * time.Millisecond)
+			seen.Store(started.Load())
+		}
+		return v, nil
+	}
+	i = 0
+	for v, err := range Pipeline(context.Background(), 4, seqN(1000), slow, WithOrdered(true)) {
+		assert(err == nil, "%d: %s", i, err)
+		assert(v == i, "exp %d, saw %d", i, v)
+		i++
+	}
+	assert(i == 1000, "exp 1000 results, saw %d", i)
+	assert(seen.Load() <= 16, "exp at most 16 inputs in flight, saw %d", seen.Load())
+
+	// the pool options apply to the pipeline's pool
+	var h countHook
+	var inflight, most atomic.Int64
+	serial := func(ctx context.Context, v int) (int, error) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		if n > most.Load() {
+			most.Store(n)
+		}
+		return square(ctx, v)
+	}
+	i = 0
+	for v, err := range Pipeline(context.Background(), 1, seqN(100), serial, WithOrdered(true),
+		WithExactSize(true), WithWorkPoolHook("pipe", &h)) {
+		assert(err == nil, "%d: %s", i, err)
+		assert(v == i*i, "%d: exp %d, saw %d", i, i*i, v)
+		i++
+	}
+	assert(i == 100, "exp 100 results, saw %d", i)
+	assert(most.Load() == 1, "exact: exp 1 input in flight, saw %d", most.Load())
+	assert(h.started.Load() == 100, "hook: exp 100 started, saw %d", h.started.Load())
+}
+
+func TestPipelineErrors(t *testing.T) {
+	assert := newAsserter(t)
+
+	errBad := errors.New("bad input")
+	odd := func(_ context.Context, v int) (int, error) {
+		if v%2 == 1 {
+			return 0, errBad
+		}
+		return v, nil
+	}
+
+	sum, err := Reduce(context.Background(), 4, seqN(10), odd, 0, func(a, v int) int {
+		return a + v
+	})
+	assert(errors.Is(err, errBad), "reduce: exp %s, saw %v", errBad, err)
+	assert(sum == 20, "exp sum 20, saw %d", sum)
+
+	sum, err = Reduce(context.Background(), 4, seqN(10), func(ctx context.Context, v int) (int, error) {
+		if v == 5 {
+			panic("bad input")
+		}
+		return v, nil
+	}, 0, func(a, v int) int {
+		return a + v
+	}, WithOrdered(true))
+
+	var pe *PanicError
+	assert(errors.As(err, &pe), "reduce: exp PanicError, saw %v", err)
+	assert(sum == 40, "exp sum 40, saw %d", sum)
+
+	var n, nerr int
+	for _, err := range Pipeline(context.Background(), 4, seqN(1000), odd, WithFailFast(true), WithOrdered(true)) {
+		n++
+		if err != nil {
+			nerr++
+		}
+	}
+	assert(nerr == 1, "exp 1 error, saw %d", nerr)
+	assert(n == 2, "exp 2 results, saw %d", n)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = Reduce(ctx, 4, seqN(10), odd, 0, func(a, v int) int {
+		return a + v
+	})
+	assert(errors.Is(err, context.Canceled), "reduce: exp cancel, saw %v", err)
+}
+
+// seqN returns an iterator over [0, n)
+func seqN(n int) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i := range n {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+}